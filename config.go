@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"ai-proxy/internal"
+	"ai-proxy/internal/limiter"
+	"ai-proxy/internal/storage"
+	"ai-proxy/internal/tokenizer"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Providers        map[string]internal.ProviderConfig `yaml:"providers"`
+	Models           []internal.Model                   `yaml:"models"`
+	ImageStorage     storage.Config                     `yaml:"image_storage"`
+	StructuredOutput internal.StructuredOutputConfig    `yaml:"structured_output"`
+	Tokenizer        tokenizer.Config                   `yaml:"tokenizer"`
+	Pools            map[string]internal.PoolConfig     `yaml:"pools"`
+	CircuitBreaker   internal.BreakerConfig             `yaml:"circuit_breaker"`
+	HealthCheck      internal.HealthCheckConfig         `yaml:"health_check"`
+	ProviderLimits   map[string]limiter.Config          `yaml:"provider_limits"`
+	Priority         internal.PriorityConfig            `yaml:"priority"`
+	Admin            internal.AdminConfig               `yaml:"admin"`
+}
+
+// loadConfig parses the config, rejecting unknown fields, and prepares its models.
+func loadConfig(data []byte) (Config, error) {
+	var config Config
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	err := decoder.Decode(&config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return config, fmt.Errorf("error in yaml.Decode: %w", err)
+	}
+
+	return config, prepareConfig(&config)
+}
+
+// prepareConfig fills the models from their providers and checks the whole
+// config, returning all problems found at once.
+func prepareConfig(config *Config) error {
+	var errs []error
+
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if config.Priority.Reserve < 0 || config.Priority.Reserve >= 1 {
+		fail("priority reserve %v is out of range, expected 0 <= reserve < 1", config.Priority.Reserve)
+	}
+
+	if config.Priority.Default != "" && !internal.IsPriority(config.Priority.Default) {
+		fail("unknown default priority %q, expected high or low", config.Priority.Default)
+	}
+
+	for key, class := range config.Priority.Keys {
+		if !internal.IsPriority(class) {
+			fail("API key %s...: unknown priority %q, expected high or low", key[:min(4, len(key))], class)
+		}
+	}
+
+	if config.StructuredOutput.MaxAttempts < 0 {
+		fail("structured_output max_attempts %d is negative", config.StructuredOutput.MaxAttempts)
+	}
+
+	if retry := config.StructuredOutput.Retry; retry != "" && retry != "same" && retry != "next" && retry != "none" {
+		fail("unknown structured_output retry %q, expected same, next or none", retry)
+	}
+
+	for name, provider := range config.Providers {
+		if provider.URL != "" {
+			if err := internal.CheckURL(provider.URL); err != nil {
+				fail("provider %s: %v", name, err)
+			}
+		}
+
+		if provider.TokenSelection != "" && !internal.IsTokenSelection(provider.TokenSelection) {
+			fail("provider %s has unknown token_selection %q", name, provider.TokenSelection)
+		}
+
+		if _, ok := config.ProviderLimits[name]; ok && provider.Config != (limiter.Config{}) {
+			fail("provider %s has limits both in providers and in provider_limits", name)
+		}
+
+		if d := provider.Discovery; d != nil {
+			if d.URL == "" && provider.URL == "" {
+				fail("provider %s has discovery but no url", name)
+			} else if d.URL != "" {
+				if err := internal.CheckURL(d.URL); err != nil {
+					fail("provider %s discovery: %v", name, err)
+				}
+			}
+
+			m := internal.ApplyProvider(d.Model, provider)
+
+			if m.Type != "" && !internal.IsModelType(m.Type) {
+				fail("provider %s discovers models of unknown type %q", name, m.Type)
+			}
+
+			if m.RequestsPerMin <= 0 || m.RequestsPerHour <= 0 || m.RequestsPerDay <= 0 {
+				fail("provider %s discovers models without requests_per_minute, requests_per_hour and requests_per_day above zero", name)
+			}
+		}
+	}
+
+	if config.ImageStorage.Type == "s3" && config.ImageStorage.Retention > 0 && config.ImageStorage.S3.Prefix == "" {
+		fail("image_storage with retention needs an s3 prefix, so that only the proxy files expire")
+	}
+
+	for name, pool := range config.Pools {
+		if name != "SMALL" && name != "BIG" {
+			fail("unknown pool %s, expected SMALL or BIG", name)
+		}
+
+		if pool.Overflow != "" && pool.Overflow != internal.OverflowTrim && pool.Overflow != internal.OverflowSummarize {
+			fail("pool %s has unknown overflow policy %q", name, pool.Overflow)
+		}
+	}
+
+	names := make(map[string]bool)
+
+	for i, v := range config.Models {
+		if v.Name == "" {
+			fail("model #%d has no name", i+1)
+		} else if names[v.Name] {
+			fail("model %s is defined twice", v.Name)
+		}
+
+		names[v.Name] = true
+
+		// older configs marked image models by leaving the type and max_request_length out
+		if v.Type == "" && v.MaxRequestLength == 0 {
+			fail("model %s has no type and no max_request_length, which used to mean an image model: "+
+				"add type: image, or type: chat for a chat model without a length limit", v.Name)
+		}
+
+		v, err := internal.PrepareModel(v, config.Providers)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		config.Models[i] = v
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkConfig is the check-config command: it validates the config file given
+// as argument or the built in one and exits with 1 if it has problems.
+func checkConfig(args []string) {
+	data := configBytes
+
+	if len(args) > 0 {
+		var err error
+
+		data, err = os.ReadFile(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	config, err := loadConfig(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config is invalid:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Config is valid: %d providers, %d models\n", len(config.Providers), len(config.Models))
+}
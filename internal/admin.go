@@ -0,0 +1,373 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"ai-proxy/internal/gigachat"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AdminConfig protects the /admin API; without a token the API is off.
+type AdminConfig struct {
+	Token string `yaml:"token"`
+}
+
+type adminModel struct {
+	Name      string          `json:"name"`
+	Type      string          `json:"type"`
+	Provider  string          `json:"provider"`
+	Priority  int             `json:"priority"`
+	Size      string          `json:"model_size,omitempty"`
+	Disabled  bool            `json:"disabled"`
+	ExpiresAt time.Time       `json:"expires_at,omitzero"` // of a temporary model
+	Limits    adminCounters   `json:"limits"`
+	Tokens    []adminCounters `json:"tokens"` // live counters, one per token
+}
+
+type adminCounters struct {
+	Minute       int       `json:"minute"`
+	Hour         int       `json:"hour"`
+	Day          int       `json:"day"`
+	LastRequest  time.Time `json:"last_request,omitzero"`
+	BlockedUntil time.Time `json:"blocked_until,omitzero"`
+}
+
+var (
+	adminMu     sync.Mutex                   // serializes the changes made through the API
+	temporary   = make(map[string]time.Time) // temporary model -> expiry, zero until restart
+	temporaryMu sync.Mutex
+)
+
+// AdminHandler serves the /admin API, which changes models and their limits at runtime.
+func AdminHandler(cfg AdminConfig) http.Handler {
+	mux := http.NewServeMux()
+
+	// model names contain slashes, so they come last in the paths
+	mux.HandleFunc("GET /admin/models", adminListModels)
+	mux.HandleFunc("POST /admin/models", adminAddModel)
+	mux.HandleFunc("PATCH /admin/models/{name...}", adminUpdateModel)
+	mux.HandleFunc("DELETE /admin/models/{name...}", adminRemoveModel)
+	mux.HandleFunc("PATCH /admin/counters/{name...}", adminSetCounters)
+	mux.HandleFunc("DELETE /admin/counters/{name...}", adminResetCounters)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+cfg.Token)) != 1 {
+			http.Error(w, "", http.StatusUnauthorized)
+
+			return
+		}
+
+		mux.ServeHTTP(w, req)
+	})
+}
+
+func adminListModels(w http.ResponseWriter, req *http.Request) {
+	models := []adminModel{}
+
+	for _, model := range ModelList() {
+		models = append(models, adminView(model))
+	}
+
+	writeJSON(w, http.StatusOK, models)
+}
+
+// adminAddModel registers a model given like in the config, as JSON or YAML,
+// with an optional ttl after which it is removed.
+func adminAddModel(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Model `yaml:",inline"`
+		TTL   time.Duration `yaml:"ttl"`
+	}
+
+	decoder := yaml.NewDecoder(req.Body)
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("error in yaml.Decode: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	if body.Name == "" {
+		http.Error(w, "model has no name", http.StatusBadRequest)
+
+		return
+	}
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	if _, found := findModel(body.Name); found {
+		http.Error(w, fmt.Sprintf("model %s already exists", body.Name), http.StatusConflict)
+
+		return
+	}
+
+	model, err := PrepareModel(body.Model, Providers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	AddModel(model)
+
+	var expiry time.Time
+
+	if body.TTL > 0 {
+		expiry = time.Now().Add(body.TTL)
+
+		time.AfterFunc(body.TTL, func() { removeTemporary(model.Name, expiry) })
+	}
+
+	setTemporary(model.Name, expiry)
+
+	log.Printf("Admin: added temporary %s model %s", model.Type, model.Name)
+	writeJSON(w, http.StatusCreated, adminView(model))
+}
+
+func removeTemporary(name string, expiry time.Time) {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	// removed or added again meanwhile
+	if at, ok := temporaryExpiry(name); !ok || !at.Equal(expiry) {
+		return
+	}
+
+	deleteTemporary(name)
+
+	if removeModel(name) {
+		log.Printf("Admin: temporary model %s expired", name)
+	}
+}
+
+func adminRemoveModel(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	if !removeModel(name) {
+		http.Error(w, fmt.Sprintf("model %q not found", name), http.StatusNotFound)
+
+		return
+	}
+
+	deleteTemporary(name)
+
+	log.Printf("Admin: removed model %s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminUpdateModel enables or disables a model and changes its priority.
+func adminUpdateModel(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Disabled *bool `json:"disabled"`
+		Priority *int  `json:"priority"`
+	}
+
+	if !readAdminJSON(w, req, &body) {
+		return
+	}
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	model, found := findModel(req.PathValue("name"))
+	if !found {
+		http.Error(w, fmt.Sprintf("model %q not found", req.PathValue("name")), http.StatusNotFound)
+
+		return
+	}
+
+	if body.Disabled != nil {
+		model.Disabled = *body.Disabled
+	}
+
+	if body.Priority != nil {
+		model.Priority = *body.Priority
+	}
+
+	AddModel(model)
+
+	log.Printf("Admin: model %s is now disabled=%v priority=%d", model.Name, model.Disabled, model.Priority)
+	writeJSON(w, http.StatusOK, adminView(model))
+}
+
+// adminSetCounters sets the counters of the current windows, of one token
+// (numbered from 1) or of all of them.
+func adminSetCounters(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Token  int  `json:"token"`
+		Minute *int `json:"minute"`
+		Hour   *int `json:"hour"`
+		Day    *int `json:"day"`
+	}
+
+	if !readAdminJSON(w, req, &body) {
+		return
+	}
+
+	changeCounters(w, req.PathValue("name"), body.Token, func(limit *RateLimit) {
+		if body.Minute != nil {
+			limit.minuteCount = *body.Minute
+		}
+
+		if body.Hour != nil {
+			limit.hourCount = *body.Hour
+		}
+
+		if body.Day != nil {
+			limit.dayCount = *body.Day
+		}
+	})
+}
+
+// adminResetCounters zeroes the counters of all tokens of the model and lifts their blocks.
+func adminResetCounters(w http.ResponseWriter, req *http.Request) {
+	changeCounters(w, req.PathValue("name"), 0, func(limit *RateLimit) {
+		limit.minuteCount = 0
+		limit.hourCount = 0
+		limit.dayCount = 0
+		limit.blockedUntil = time.Time{}
+	})
+}
+
+func changeCounters(w http.ResponseWriter, name string, token int, change func(*RateLimit)) {
+	model, found := findModel(name)
+	if !found {
+		http.Error(w, fmt.Sprintf("model %q not found", name), http.StatusNotFound)
+
+		return
+	}
+
+	limits := modelRateLimits(name)
+	if token < 0 || token > len(limits) {
+		http.Error(w, fmt.Sprintf("model %q has %d tokens", name, len(limits)), http.StatusBadRequest)
+
+		return
+	}
+
+	now := time.Now()
+
+	for i, limit := range limits {
+		if token > 0 && i != token-1 {
+			continue
+		}
+
+		limit.mux.Lock()
+		updateLimitCounters(limit, now)
+		change(limit)
+		limit.mux.Unlock()
+	}
+
+	log.Printf("Admin: changed the counters of %s", name)
+	writeJSON(w, http.StatusOK, adminView(model))
+}
+
+func adminView(model Model) adminModel {
+	res := adminModel{
+		Name:     model.Name,
+		Type:     model.Type,
+		Provider: model.Provider,
+		Priority: model.Priority,
+		Size:     model.Size,
+		Disabled: model.Disabled,
+		Limits:   adminCounters{Minute: model.RequestsPerMin, Hour: model.RequestsPerHour, Day: model.RequestsPerDay},
+		Tokens:   []adminCounters{},
+	}
+
+	res.ExpiresAt, _ = temporaryExpiry(model.Name)
+
+	now := time.Now()
+
+	for _, limit := range modelRateLimits(model.Name) {
+		limit.mux.Lock()
+		updateLimitCounters(limit, now)
+		res.Tokens = append(res.Tokens, adminCounters{
+			Minute:       limit.minuteCount,
+			Hour:         limit.hourCount,
+			Day:          limit.dayCount,
+			LastRequest:  limit.lastRequest,
+			BlockedUntil: limit.blockedUntil,
+		})
+		limit.mux.Unlock()
+	}
+
+	return res
+}
+
+// removeModel drops the model and the gigachat access tokens no other model
+// shares, so that a removed account is not kept signed in.
+func removeModel(name string) bool {
+	model, found := findModel(name)
+	if !found || !RemoveModel(name) {
+		return false
+	}
+
+	if model.Provider != "gigachat" {
+		return true
+	}
+
+	for _, token := range append(slices.Clone(model.Tokens), model.Token) {
+		if !slices.ContainsFunc(ModelList(), func(m Model) bool { return m.Token == token || slices.Contains(m.Tokens, token) }) {
+			gigachat.ForgetToken(token)
+		}
+	}
+
+	return true
+}
+
+func temporaryExpiry(name string) (time.Time, bool) {
+	temporaryMu.Lock()
+	defer temporaryMu.Unlock()
+
+	expiry, ok := temporary[name]
+
+	return expiry, ok
+}
+
+func setTemporary(name string, expiry time.Time) {
+	temporaryMu.Lock()
+	defer temporaryMu.Unlock()
+
+	temporary[name] = expiry
+}
+
+func deleteTemporary(name string) {
+	temporaryMu.Lock()
+	defer temporaryMu.Unlock()
+
+	delete(temporary, name)
+}
+
+func readAdminJSON(w http.ResponseWriter, req *http.Request, v any) bool {
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("error in json.Decode: %v", err), http.StatusBadRequest)
+
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
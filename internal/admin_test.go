@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminAddModelRejects(t *testing.T) {
+	useModels(t, testModel("p/a", "p"))
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"no name", "provider: p\n", http.StatusBadRequest},
+		{"duplicate", "name: p/a\nprovider: p\n", http.StatusConflict},
+		{"unknown field", "name: p/b\nsize_: SMALL\n", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			adminAddModel(w, httptest.NewRequest(http.MethodPost, "/admin/models", strings.NewReader(tt.body)))
+
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+
+	"ai-proxy/internal/cloudflare"
+	"ai-proxy/internal/openai"
+)
+
+// Пример запроса
+// curl http://127.0.0.1:8080/v1/audio/transcriptions -F file=@meeting.mp3 -F model=whisper-1 -F language=ru
+
+const maxAudioUploadSize = 25 << 20
+
+// transcriptionFormats are the response formats of the OpenAI API.
+var transcriptionFormats = []string{"", "json", "text", "srt", "verbose_json", "vtt"}
+
+type TranscriptionParams struct {
+	File           []byte
+	FileName       string
+	Language       string
+	Prompt         string
+	ResponseFormat string
+	Temperature    string
+	Translate      bool
+}
+
+type audioResponse struct {
+	Body        []byte
+	ContentType string
+}
+
+// HandlerTranscription implements the OpenAI compatible /audio/transcriptions endpoint.
+func HandlerTranscription(w http.ResponseWriter, req *http.Request) {
+	handleAudioUpload(w, req, false)
+}
+
+// HandlerTranslation implements the OpenAI compatible /audio/translations endpoint (speech to English text).
+func HandlerTranslation(w http.ResponseWriter, req *http.Request) {
+	handleAudioUpload(w, req, true)
+}
+
+func handleAudioUpload(w http.ResponseWriter, req *http.Request, translate bool) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, maxAudioUploadSize)
+
+	err := req.ParseMultipartForm(maxAudioUploadSize)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Audio file is larger than %d bytes", maxAudioUploadSize), http.StatusRequestEntityTooLarge)
+
+			return
+		}
+
+		http.Error(w, "Invalid multipart form", http.StatusBadRequest)
+
+		return
+	}
+
+	file, header, err := req.FormFile("file")
+	if err != nil {
+		http.Error(w, "Audio file is required", http.StatusBadRequest)
+
+		return
+	}
+
+	defer file.Close()
+
+	params := TranscriptionParams{
+		FileName:       header.Filename,
+		Language:       req.FormValue("language"),
+		Prompt:         req.FormValue("prompt"),
+		ResponseFormat: req.FormValue("response_format"),
+		Temperature:    req.FormValue("temperature"),
+		Translate:      translate,
+	}
+
+	if !slices.Contains(transcriptionFormats, params.ResponseFormat) {
+		http.Error(w, fmt.Sprintf("Unsupported response_format %q", params.ResponseFormat), http.StatusBadRequest)
+
+		return
+	}
+
+	params.File, err = io.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	var response audioResponse
+
+	modelName := req.FormValue("model")
+	if isModelName(modelName, ModelTypeAudio) {
+		model, _ := getModelByName(modelName)
+		if !supportsResponseFormat(model, params.ResponseFormat) {
+			http.Error(w, fmt.Sprintf("Model %s does not support response_format %q", modelName, params.ResponseFormat), http.StatusBadRequest)
+
+			return
+		}
+
+		response, err = transcribe(req.Context(), modelName, params)
+	} else {
+		// OpenAI clients send their own model name (whisper-1), route it to the pool
+		response, err = callWithFailover(func(model Model) bool {
+			return model.Type == ModelTypeAudio && (!translate || supportsTranslation(model)) &&
+				supportsResponseFormat(model, params.ResponseFormat)
+		}, func(modelName string) (audioResponse, error) {
+			return transcribe(req.Context(), modelName, params)
+		})
+	}
+
+	if errors.Is(err, errNoModels) {
+		http.Error(w, "No available audio models", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	if err != nil {
+		log.Printf("ERROR: %s, body: %s\n", err, string(response.Body))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", response.ContentType)
+	w.Write(response.Body)
+}
+
+// isModelName reports whether name is a configured model of the given type.
+func isModelName(name, modelType string) bool {
+	for _, model := range ModelList() {
+		if model.Name == name && model.Type == modelType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func supportsTranslation(model Model) bool {
+	if model.Provider == "cloudflare" {
+		return strings.Contains(model.URL, "whisper-large-v3-turbo")
+	}
+
+	return true
+}
+
+// supportsResponseFormat reports whether the model can answer in format; Workers AI
+// results are rendered by formatTranscription, which has no srt.
+func supportsResponseFormat(model Model, format string) bool {
+	return model.Provider != "cloudflare" || format != "srt"
+}
+
+func transcribe(ctx context.Context, modelName string, params TranscriptionParams) (audioResponse, error) {
+	model, found := getModelByName(modelName)
+	if !found {
+		return audioResponse{}, fmt.Errorf("Specified model not found - %s", modelName)
+	}
+
+	log.Printf("Request to audio model: %s - %s, %d bytes\n", modelName, params.FileName, len(params.File))
+
+	release, err := acquireModel(ctx, model)
+	if err != nil {
+		return audioResponse{}, err
+	}
+
+	defer release()
+
+	ctx, cancel := modelContext(ctx, model)
+	defer cancel()
+
+	if model.Provider == "cloudflare" {
+		result, err := callWithToken(model, func(token string) (cloudflare.TranscriptionResult, error) {
+			return cloudflare.Transcribe(ctx, model.URL, token, params.File, params.Language, params.Prompt, params.Translate)
+		})
+		if err != nil {
+			return audioResponse{}, err
+		}
+
+		return formatTranscription(result, params)
+	}
+
+	body, contentType, err := buildTranscriptionForm(strings.TrimPrefix(model.Name, model.Provider+"/"), params)
+	if err != nil {
+		return audioResponse{}, err
+	}
+
+	providerURL := model.URL
+	if params.Translate {
+		providerURL = strings.Replace(providerURL, "/audio/transcriptions", "/audio/translations", 1)
+	}
+
+	return callWithToken(model, func(token string) (audioResponse, error) {
+		resp, respContentType, err := openai.CallMultipart(ctx, providerURL, token, contentType, body)
+		if err != nil {
+			return audioResponse{Body: resp}, err
+		}
+
+		return audioResponse{Body: resp, ContentType: respContentType}, nil
+	})
+}
+
+// buildTranscriptionForm rebuilds the multipart form for an OpenAI compatible provider.
+func buildTranscriptionForm(model string, params TranscriptionParams) ([]byte, string, error) {
+	var buf bytes.Buffer
+
+	form := multipart.NewWriter(&buf)
+
+	fileName := params.FileName
+	if fileName == "" {
+		fileName = "audio.mp3"
+	}
+
+	part, err := form.CreateFormFile("file", fileName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = part.Write(params.File)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fields := [][2]string{
+		{"model", model},
+		{"prompt", params.Prompt},
+		{"response_format", params.ResponseFormat},
+		{"temperature", params.Temperature},
+	}
+
+	// translations are always into English and have no language field
+	if !params.Translate {
+		fields = append(fields, [2]string{"language", params.Language})
+	}
+
+	for _, field := range fields {
+		if field[1] == "" {
+			continue
+		}
+
+		err = form.WriteField(field[0], field[1])
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	err = form.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), form.FormDataContentType(), nil
+}
+
+type verboseTranscription struct {
+	Task     string           `json:"task"`
+	Language string           `json:"language,omitempty"`
+	Duration float64          `json:"duration,omitempty"`
+	Text     string           `json:"text"`
+	Segments []verboseSegment `json:"segments"`
+}
+
+type verboseSegment struct {
+	ID int `json:"id"`
+	cloudflare.Segment
+}
+
+// formatTranscription renders a Workers AI result in the requested OpenAI response format.
+func formatTranscription(result cloudflare.TranscriptionResult, params TranscriptionParams) (audioResponse, error) {
+	switch params.ResponseFormat {
+	case "", "json":
+		body, err := json.Marshal(map[string]string{"text": result.Text})
+
+		return audioResponse{Body: body, ContentType: "application/json"}, err
+	case "verbose_json":
+		verbose := verboseTranscription{
+			Task:     "transcribe",
+			Language: result.Language,
+			Duration: result.Duration,
+			Text:     result.Text,
+			Segments: []verboseSegment{},
+		}
+
+		if params.Translate {
+			verbose.Task = "translate"
+		}
+
+		for i, segment := range result.Segments {
+			verbose.Segments = append(verbose.Segments, verboseSegment{ID: i, Segment: segment})
+		}
+
+		body, err := json.Marshal(verbose)
+
+		return audioResponse{Body: body, ContentType: "application/json"}, err
+	case "text":
+		return audioResponse{Body: []byte(result.Text), ContentType: "text/plain; charset=utf-8"}, nil
+	case "vtt":
+		if result.VTT == "" {
+			return audioResponse{}, errors.New("model returned no vtt subtitles")
+		}
+
+		return audioResponse{Body: []byte(result.VTT), ContentType: "text/vtt; charset=utf-8"}, nil
+	default:
+		return audioResponse{}, fmt.Errorf("unsupported response_format %q", params.ResponseFormat)
+	}
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ai-proxy/internal/cloudflare"
+
+	"github.com/tidwall/gjson"
+)
+
+func audioRequest(t *testing.T, file []byte, fields map[string]string) *http.Request {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	form := multipart.NewWriter(&buf)
+
+	part, err := form.CreateFormFile("file", "a.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	part.Write(file)
+
+	for key, value := range fields {
+		form.WriteField(key, value)
+	}
+
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/audio/transcriptions", &buf)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	return req
+}
+
+func TestHandlerTranscriptionRejects(t *testing.T) {
+	useModels(t)
+
+	tests := []struct {
+		name   string
+		file   []byte
+		fields map[string]string
+		want   int
+	}{
+		{"unknown format", []byte("audio"), map[string]string{"response_format": "xml"}, http.StatusBadRequest},
+		{"too large", make([]byte, maxAudioUploadSize+1), nil, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			HandlerTranscription(w, audioRequest(t, tt.file, tt.fields))
+
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestFormatTranscriptionVerbose(t *testing.T) {
+	result := cloudflare.TranscriptionResult{
+		Text:     "Hello world",
+		Language: "en",
+		Duration: 1.5,
+		Segments: []cloudflare.Segment{{Start: 0, End: 0.7, Text: "Hello"}, {Start: 0.7, End: 1.5, Text: "world"}},
+	}
+
+	response, err := formatTranscription(result, TranscriptionParams{ResponseFormat: "verbose_json", Translate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := gjson.ParseBytes(response.Body)
+	if body.Get("task").String() != "translate" || body.Get("language").String() != "en" ||
+		body.Get("segments.1.id").Int() != 1 || body.Get("segments.1.text").String() != "world" {
+		t.Errorf("verbose_json = %s", response.Body)
+	}
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"ai-proxy/internal/httpclient"
+)
+
+type BreakerConfig struct {
+	Model    BreakerLevel `yaml:"model"`
+	Provider BreakerLevel `yaml:"provider"`
+}
+
+type BreakerLevel struct {
+	Failures    int           `yaml:"failures"`     // consecutive errors that open the circuit
+	OpenTimeout time.Duration `yaml:"open_timeout"` // time before a probe request is let through
+}
+
+// CircuitBreaker holds the thresholds; a model opens after one error and a
+// provider after three errors in a row, both for a minute, unless configured.
+var CircuitBreaker BreakerConfig
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen // a single probe request is in flight
+)
+
+type circuit struct {
+	name     string // model or provider, for the log
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+var (
+	circuits   = make(map[string]*circuit)
+	circuitsMu sync.Mutex
+)
+
+func modelBreaker() BreakerLevel {
+	return BreakerLevel{
+		Failures:    cmp.Or(CircuitBreaker.Model.Failures, 1),
+		OpenTimeout: cmp.Or(CircuitBreaker.Model.OpenTimeout, time.Minute),
+	}
+}
+
+func providerBreaker() BreakerLevel {
+	return BreakerLevel{
+		Failures:    cmp.Or(CircuitBreaker.Provider.Failures, 3),
+		OpenTimeout: cmp.Or(CircuitBreaker.Provider.OpenTimeout, time.Minute),
+	}
+}
+
+// modelCircuits returns the circuits of the model and of its provider, creating them on first use.
+func modelCircuits(model Model) [2]*circuit {
+	var res [2]*circuit
+
+	for i, key := range [2]string{"model " + model.Name, "provider " + model.Provider} {
+		if circuits[key] == nil {
+			circuits[key] = &circuit{name: key}
+		}
+
+		res[i] = circuits[key]
+	}
+
+	return res
+}
+
+func (c *circuit) allows(level BreakerLevel, now time.Time) bool {
+	switch c.state {
+	case circuitOpen:
+		return now.Sub(c.openedAt) >= level.OpenTimeout
+	case circuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// circuitAllows reports whether the model can be selected: both circuits are
+// closed, or open long enough for a probe.
+func circuitAllows(model Model, now time.Time) bool {
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+
+	c := modelCircuits(model)
+
+	return c[0].allows(modelBreaker(), now) && c[1].allows(providerBreaker(), now)
+}
+
+// nextModel selects a model like selectModel and makes the request the probe
+// of the circuits that are due for one.
+func nextModel(match func(Model) bool) string {
+	var skipped []string
+
+	for {
+		modelName := selectModel(func(model Model) bool {
+			return match(model) && !slices.Contains(skipped, model.Name)
+		})
+		if modelName == "" || claimCircuits(modelName) {
+			return modelName
+		}
+
+		// another request has just taken the probe
+		skipped = append(skipped, modelName)
+	}
+}
+
+func claimCircuits(modelName string) bool {
+	model, found := findModel(modelName)
+	if !found {
+		return false
+	}
+
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+
+	now := time.Now()
+	c := modelCircuits(model)
+
+	if !c[0].allows(modelBreaker(), now) || !c[1].allows(providerBreaker(), now) {
+		return false
+	}
+
+	for _, c := range c {
+		if c.state == circuitOpen {
+			c.state = circuitHalfOpen
+		}
+	}
+
+	return true
+}
+
+// reportResult updates the circuits of the model after a request. Requests
+// cancelled by the client and errors caused by the request itself say nothing
+// about the model and only free the probe.
+func reportResult(modelName string, err error) {
+	model, found := findModel(modelName)
+	if !found {
+		return
+	}
+
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+
+	c := modelCircuits(model)
+
+	switch {
+	case err == nil:
+		for _, c := range c {
+			if c.state != circuitClosed {
+				log.Printf("Circuit of %s closed", c.name)
+			}
+
+			*c = circuit{name: c.name}
+		}
+	case errors.Is(err, context.Canceled) || !upstreamFailure(err):
+		for _, c := range c {
+			if c.state == circuitHalfOpen {
+				c.state = circuitOpen
+			}
+		}
+	default:
+		now := time.Now()
+
+		c[0].fail(modelBreaker(), now)
+		c[1].fail(providerBreaker(), now)
+	}
+}
+
+// upstreamFailure tells whether err means the model or its provider is down:
+// a network error, a timeout, a 5xx or a 429 response.
+func upstreamFailure(err error) bool {
+	if code := httpclient.StatusCode(err); code != 0 {
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (c *circuit) fail(level BreakerLevel, now time.Time) {
+	c.failures++
+
+	if c.state == circuitHalfOpen || c.state == circuitClosed && c.failures >= level.Failures {
+		log.Printf("Circuit of %s opened for %v after %d errors", c.name, level.OpenTimeout, c.failures)
+
+		c.state = circuitOpen
+		c.openedAt = now
+	}
+}
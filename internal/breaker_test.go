@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"ai-proxy/internal/httpclient"
+)
+
+// useModels replaces the registered models for a test.
+func useModels(t *testing.T, models ...Model) {
+	t.Helper()
+
+	modelsMu.Lock()
+	prevModels, prevLimits := Models, RateLimits
+	Models, RateLimits = models, make(map[string][]*RateLimit)
+
+	for _, model := range models {
+		RateLimits[model.Name] = NewRateLimits(model)
+	}
+	modelsMu.Unlock()
+
+	circuitsMu.Lock()
+	prevCircuits := circuits
+	circuits = make(map[string]*circuit)
+	circuitsMu.Unlock()
+
+	t.Cleanup(func() {
+		modelsMu.Lock()
+		Models, RateLimits = prevModels, prevLimits
+		modelsMu.Unlock()
+
+		circuitsMu.Lock()
+		circuits = prevCircuits
+		circuitsMu.Unlock()
+	})
+}
+
+func testModel(name, provider string) Model {
+	return Model{
+		Name: name, Type: ModelTypeChat, Provider: provider, Size: "SMALL",
+		RequestsPerMin: 10, RequestsPerHour: 100, RequestsPerDay: 1000,
+	}
+}
+
+// expireCircuits moves the opening of every open circuit back by d.
+func expireCircuits(d time.Duration) {
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+
+	for _, c := range circuits {
+		c.openedAt = c.openedAt.Add(-d)
+	}
+}
+
+func TestModelCircuit(t *testing.T) {
+	a := testModel("p/a", "p")
+	useModels(t, a)
+
+	errUpstream := &httpclient.StatusError{Code: 502}
+
+	if !circuitAllows(a, time.Now()) {
+		t.Fatal("a new circuit must be closed")
+	}
+
+	reportResult(a.Name, errUpstream)
+
+	if circuitAllows(a, time.Now()) {
+		t.Fatal("the circuit must open after one error")
+	}
+
+	if got := nextModel(func(Model) bool { return true }); got != "" {
+		t.Fatalf("nextModel = %q with the only model open", got)
+	}
+
+	expireCircuits(time.Minute)
+
+	if got := nextModel(func(Model) bool { return true }); got != a.Name {
+		t.Fatalf("nextModel = %q, want the model as a probe", got)
+	}
+
+	if claimCircuits(a.Name) {
+		t.Fatal("a second probe must not be let through while one is in flight")
+	}
+
+	// a failed probe opens the circuit again at once
+	reportResult(a.Name, errUpstream)
+
+	if circuitAllows(a, time.Now()) {
+		t.Fatal("the circuit must open again after a failed probe")
+	}
+
+	expireCircuits(time.Minute)
+
+	if !claimCircuits(a.Name) {
+		t.Fatal("the probe must be let through after the timeout")
+	}
+
+	reportResult(a.Name, nil)
+
+	if !circuitAllows(a, time.Now()) || !claimCircuits(a.Name) {
+		t.Fatal("a successful probe must close the circuit")
+	}
+}
+
+func TestCancelledProbeFreesCircuit(t *testing.T) {
+	a := testModel("p/a", "p")
+	useModels(t, a)
+
+	reportResult(a.Name, &httpclient.StatusError{Code: 503})
+	expireCircuits(time.Minute)
+
+	if !claimCircuits(a.Name) {
+		t.Fatal("the probe must be let through after the timeout")
+	}
+
+	reportResult(a.Name, context.Canceled)
+
+	if !claimCircuits(a.Name) {
+		t.Fatal("a cancelled probe must let the next request probe")
+	}
+}
+
+func TestProviderCircuit(t *testing.T) {
+	a, b, c := testModel("p/a", "p"), testModel("p/b", "p"), testModel("q/c", "q")
+	useModels(t, a, b, c)
+
+	CircuitBreaker.Model.Failures = 10
+	t.Cleanup(func() { CircuitBreaker.Model.Failures = 0 })
+
+	errUpstream := &httpclient.StatusError{Code: 500}
+
+	reportResult(a.Name, errUpstream)
+	reportResult(b.Name, errUpstream)
+
+	if !circuitAllows(a, time.Now()) {
+		t.Fatal("the provider circuit must stay closed after two errors")
+	}
+
+	reportResult(a.Name, errUpstream)
+
+	if circuitAllows(a, time.Now()) || circuitAllows(b, time.Now()) {
+		t.Fatal("the provider circuit must open for all its models after three errors")
+	}
+
+	if !circuitAllows(c, time.Now()) {
+		t.Fatal("other providers must not be affected")
+	}
+}
+
+func TestUpstreamFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&httpclient.StatusError{Code: 500}, true},
+		{fmt.Errorf("call: %w", &httpclient.StatusError{Code: 429}), true},
+		{&httpclient.StatusError{Code: 400}, false},
+		{&httpclient.StatusError{Code: 404}, false},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{context.DeadlineExceeded, true},
+		{errImageInputUnsupported, false},
+		{errors.New("no content"), false},
+	}
+
+	for _, tt := range tests {
+		if got := upstreamFailure(tt.err); got != tt.want {
+			t.Errorf("upstreamFailure(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRequestErrorKeepsCircuitClosed(t *testing.T) {
+	a := testModel("p/a", "p")
+	useModels(t, a)
+
+	for range 5 {
+		reportResult(a.Name, &httpclient.StatusError{Code: 400})
+	}
+
+	if !circuitAllows(a, time.Now()) {
+		t.Fatal("errors caused by the request must not open the circuit")
+	}
+}
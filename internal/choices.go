@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	maxChoices        = 10 // n above it is refused, every missing choice may cost a request
+	fanOutConcurrency = 4  // parallel requests for the missing choices
+)
+
+// checkChoices refuses requests for more choices than maxChoices.
+func checkChoices(reqBodyBytes []byte) error {
+	if n := gjson.GetBytes(reqBodyBytes, "n").Int(); n > maxChoices {
+		return fmt.Errorf("n must not exceed %d", maxChoices)
+	}
+
+	return nil
+}
+
+// fanOutChoices completes a response to n choices for providers that ignore n,
+// sending the missing ones as single-choice requests, fanOutConcurrency at a time. With a pool alias
+// every request picks its own model.
+func fanOutChoices(ctx context.Context, reqBodyBytes, response []byte, missing int, opts chatOptions) ([]byte, error) {
+	body, err := sjson.DeleteBytes(reqBodyBytes, "n")
+	if err != nil {
+		return nil, fmt.Errorf("error in sjson.DeleteBytes: %w", err)
+	}
+
+	var wg sync.WaitGroup
+
+	sem := make(chan struct{}, fanOutConcurrency)
+	responses := make([][]byte, missing)
+	errs := make([]error, missing)
+
+	for i := range missing {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			responses[i], errs[i] = completeOne(ctx, body, opts)
+		}()
+	}
+
+	wg.Wait()
+
+	for i, resp := range responses {
+		if errs[i] != nil {
+			// the client still gets the choices collected so far
+			log.Printf("Error getting extra choice: %v", errs[i])
+
+			continue
+		}
+
+		response, err = mergeChoices(response, resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+// mergeChoices appends the choices of extra to response, renumbering them, and adds up the usage.
+func mergeChoices(response, extra []byte) ([]byte, error) {
+	var err error
+
+	index := gjson.GetBytes(response, "choices.#").Int()
+
+	for _, choice := range gjson.GetBytes(extra, "choices").Array() {
+		raw, err := sjson.SetBytes([]byte(choice.Raw), "index", index)
+		if err != nil {
+			return nil, fmt.Errorf("error in sjson.SetBytes: %w", err)
+		}
+
+		response, err = sjson.SetRawBytes(response, "choices.-1", raw)
+		if err != nil {
+			return nil, fmt.Errorf("error in sjson.SetRawBytes: %w", err)
+		}
+
+		index++
+	}
+
+	for _, field := range []string{"prompt_tokens", "completion_tokens", "total_tokens"} {
+		value := gjson.GetBytes(extra, "usage."+field)
+		if !value.Exists() {
+			continue
+		}
+
+		response, err = sjson.SetBytes(response, "usage."+field, gjson.GetBytes(response, "usage."+field).Int()+value.Int())
+		if err != nil {
+			return nil, fmt.Errorf("error in sjson.SetBytes: %w", err)
+		}
+	}
+
+	return response, nil
+}
@@ -1,21 +1,13 @@
 package cloudflare
 
 import (
+	"ai-proxy/internal/httpclient"
 	"ai-proxy/internal/schema"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"time"
-)
-
-var (
-	queue           = make(chan interface{}, 1)
-	lastTimeRequest = time.Now()
-
-	maxTimeoutTime = 1 * time.Second
 )
 
 func CreateRequest(providerURL, model, token string, reqBody schema.RequestOpenAICompatable) (*http.Request, error) {
@@ -37,27 +29,14 @@ func CreateRequest(providerURL, model, token string, reqBody schema.RequestOpenA
 	return req, nil
 }
 
+// Call отправляет запрос без ограничений, очередь и паузы между запросами задает вызывающий код.
 func Call(providerURL, model, token string, reqBody schema.RequestOpenAICompatable) ([]byte, error) {
-	// Выполняем запросы в 1 поток
-	queue <- struct{}{}
-	defer func() {
-		// Запоминаем время последнего запроса и очищаем очередь
-		lastTimeRequest = time.Now()
-
-		<-queue
-	}()
-
-	if !time.Now().After(lastTimeRequest.Add(maxTimeoutTime)) {
-		log.Printf("Throttled %v seс for %s", time.Until(lastTimeRequest.Add(maxTimeoutTime)).Seconds(), model)
-		time.Sleep(time.Until(lastTimeRequest.Add(maxTimeoutTime)))
-	}
-
 	req, err := CreateRequest(providerURL, model, token, reqBody)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpclient.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,60 @@
+package cloudflare
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"ai-proxy/internal/httpclient"
+
+	"github.com/tidwall/gjson"
+)
+
+type melottsRequest struct {
+	Prompt string `json:"prompt"`
+	Lang   string `json:"lang,omitempty"`
+}
+
+// Speak runs the MeloTTS model and returns mp3 audio.
+func Speak(ctx context.Context, providerURL, token, text, lang string) ([]byte, error) {
+	jsonBody, err := json.Marshal(melottsRequest{Prompt: text, Lang: lang})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, providerURL, bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	resp, err := httpclient.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w, body: %s", &httpclient.StatusError{Code: resp.StatusCode}, body)
+	}
+
+	// the model answers with JSON when called with a JSON body
+	audio := gjson.GetBytes(body, "result.audio")
+	if !audio.Exists() {
+		return body, nil
+	}
+
+	return base64.StdEncoding.DecodeString(audio.String())
+}
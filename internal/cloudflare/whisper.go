@@ -0,0 +1,118 @@
+package cloudflare
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"ai-proxy/internal/httpclient"
+
+	"github.com/tidwall/gjson"
+)
+
+type TranscriptionResult struct {
+	Text     string
+	VTT      string
+	Language string  // detected language, only from whisper-large-v3-turbo
+	Duration float64 // seconds, only from whisper-large-v3-turbo
+	Segments []Segment
+}
+
+type Segment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+type whisperRequest struct {
+	Audio         string `json:"audio"`
+	Task          string `json:"task,omitempty"`
+	Language      string `json:"language,omitempty"`
+	InitialPrompt string `json:"initial_prompt,omitempty"`
+}
+
+// Transcribe runs a Workers AI Whisper model. whisper-large-v3-turbo takes a JSON
+// body and can translate, the older models take the raw audio file.
+func Transcribe(ctx context.Context, providerURL, token string, audio []byte, language, prompt string, translate bool) (TranscriptionResult, error) {
+	var (
+		body        []byte
+		contentType = "application/octet-stream"
+	)
+
+	if strings.Contains(providerURL, "whisper-large-v3-turbo") {
+		payload := whisperRequest{
+			Audio:         base64.StdEncoding.EncodeToString(audio),
+			Task:          "transcribe",
+			Language:      language,
+			InitialPrompt: prompt,
+		}
+
+		if translate {
+			payload.Task = "translate"
+		}
+
+		jsonBody, err := json.Marshal(payload)
+		if err != nil {
+			return TranscriptionResult{}, err
+		}
+
+		body = jsonBody
+		contentType = "application/json"
+	} else {
+		if translate {
+			return TranscriptionResult{}, fmt.Errorf("translation is supported only by whisper-large-v3-turbo")
+		}
+
+		body = audio
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, providerURL, bytes.NewReader(body))
+	if err != nil {
+		return TranscriptionResult{}, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	resp, err := httpclient.Client.Do(req)
+	if err != nil {
+		return TranscriptionResult{}, err
+	}
+
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return TranscriptionResult{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return TranscriptionResult{}, fmt.Errorf("%w, body: %s", &httpclient.StatusError{Code: resp.StatusCode}, respBody)
+	}
+
+	result := TranscriptionResult{
+		Text:     gjson.GetBytes(respBody, "result.text").String(),
+		VTT:      gjson.GetBytes(respBody, "result.vtt").String(),
+		Language: gjson.GetBytes(respBody, "result.transcription_info.language").String(),
+		Duration: gjson.GetBytes(respBody, "result.transcription_info.duration").Float(),
+	}
+
+	for _, segment := range gjson.GetBytes(respBody, "result.segments").Array() {
+		result.Segments = append(result.Segments, Segment{
+			Start: segment.Get("start").Float(),
+			End:   segment.Get("end").Float(),
+			Text:  segment.Get("text").String(),
+		})
+	}
+
+	if result.Text == "" {
+		return result, fmt.Errorf("empty transcription: %s", respBody)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,420 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Пример запроса
+// curl http://127.0.0.1:8080/v1/completions -d '{"model": "SMALL", "prompt": "Once upon a time", "max_tokens": 50}'
+
+// maxPrompts limits the prompts of a request, each one is a separate chat request.
+const maxPrompts = maxChoices
+
+type ResponseCompletion struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *CompletionUsage   `json:"usage,omitempty"`
+}
+
+type CompletionChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	Logprobs     any     `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+type CompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// HandlerCompletions implements the legacy /completions endpoint on top of the chat pipeline.
+func HandlerCompletions(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	reqBodyBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if !gjson.ValidBytes(reqBodyBytes) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+
+		return
+	}
+
+	opts, err := parseChatOptions(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	prompts, err := parsePrompts(gjson.GetBytes(reqBodyBytes, "prompt"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if err := checkChoices(reqBodyBytes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	n := max(int(gjson.GetBytes(reqBodyBytes, "n").Int()), 1)
+	if n*len(prompts) > maxChoices {
+		http.Error(w, fmt.Sprintf("n times the number of prompts must not exceed %d", maxChoices), http.StatusBadRequest)
+
+		return
+	}
+
+	echo := gjson.GetBytes(reqBodyBytes, "echo").Bool()
+	stop := parseStop(gjson.GetBytes(reqBodyBytes, "stop"))
+
+	// several choices or prompts are collected first and replayed, like echo
+	if gjson.GetBytes(reqBodyBytes, "stream").Bool() && n == 1 && !echo && len(prompts) == 1 {
+		streamCompletion(req.Context(), w, reqBodyBytes, prompts[0], stop, opts)
+
+		return
+	}
+
+	response := ResponseCompletion{
+		ID:      "cmpl-" + uuid.NewString(),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Usage:   &CompletionUsage{},
+	}
+
+	for i, prompt := range prompts {
+		chatBody, err := completionToChat(reqBodyBytes, prompt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		choices, err := completeChoices(req.Context(), chatBody, n, opts, &response)
+		if err != nil {
+			writeChatError(w, err)
+
+			return
+		}
+
+		for j, choice := range choices {
+			text, finishReason := applyStop(choice.Get("message.content").String(), choice.Get("finish_reason").String(), stop)
+			if echo {
+				text = prompt + text
+			}
+
+			response.Choices = append(response.Choices, CompletionChoice{
+				Text:         text,
+				Index:        i*n + j,
+				FinishReason: &finishReason,
+			})
+		}
+	}
+
+	opts.context.writeHeaders(w)
+
+	if gjson.GetBytes(reqBodyBytes, "stream").Bool() {
+		writeCompletionStream(w, response)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// completeChoices asks the chat pipeline for n choices and adds the usage to the response.
+func completeChoices(ctx context.Context, chatBody []byte, n int, opts chatOptions, response *ResponseCompletion) ([]gjson.Result, error) {
+	if n > 1 {
+		var err error
+
+		chatBody, err = sjson.SetBytes(chatBody, "n", n)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := completeChat(ctx, chatBody, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Model = gjson.GetBytes(resp, "model").String()
+	response.Usage.PromptTokens += int(gjson.GetBytes(resp, "usage.prompt_tokens").Int())
+	response.Usage.CompletionTokens += int(gjson.GetBytes(resp, "usage.completion_tokens").Int())
+	response.Usage.TotalTokens += int(gjson.GetBytes(resp, "usage.total_tokens").Int())
+
+	choices := gjson.GetBytes(resp, "choices").Array()
+	if len(choices) > n {
+		choices = choices[:n]
+	}
+
+	return choices, nil
+}
+
+// completionToChat wraps the prompt into a user message and drops the fields chat models do not know.
+func completionToChat(reqBodyBytes []byte, prompt string) ([]byte, error) {
+	var err error
+
+	body := reqBodyBytes
+
+	for _, field := range []string{"prompt", "echo", "suffix", "best_of", "logprobs", "n", "stream", "stream_options"} {
+		body, err = sjson.DeleteBytes(body, field)
+		if err != nil {
+			return nil, fmt.Errorf("error in sjson.DeleteBytes: %w", err)
+		}
+	}
+
+	return sjson.SetBytes(body, "messages", []map[string]string{{"role": "user", "content": prompt}})
+}
+
+func parsePrompts(prompt gjson.Result) ([]string, error) {
+	switch {
+	case prompt.Type == gjson.String:
+		return []string{prompt.String()}, nil
+	case prompt.IsArray():
+		var prompts []string
+
+		for _, v := range prompt.Array() {
+			if v.Type != gjson.String {
+				return nil, errors.New("token array prompts are not supported")
+			}
+
+			prompts = append(prompts, v.String())
+		}
+
+		if len(prompts) > maxPrompts {
+			return nil, fmt.Errorf("prompt must not have more than %d items", maxPrompts)
+		}
+
+		if len(prompts) > 0 {
+			return prompts, nil
+		}
+	}
+
+	return nil, errors.New("empty prompt")
+}
+
+func parseStop(stop gjson.Result) []string {
+	if stop.Type == gjson.String {
+		return []string{stop.String()}
+	}
+
+	var res []string
+
+	for _, v := range stop.Array() {
+		res = append(res, v.String())
+	}
+
+	return res
+}
+
+// applyStop cuts the text at the first stop sequence for providers that ignore stop.
+func applyStop(text, finishReason string, stop []string) (string, string) {
+	if cut := stopIndex(text, stop); cut != -1 {
+		return text[:cut], "stop"
+	}
+
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+
+	return text, finishReason
+}
+
+// stopIndex returns the position of the first stop sequence in text, -1 if there is none.
+func stopIndex(text string, stop []string) int {
+	cut := -1
+
+	for _, s := range stop {
+		if i := strings.Index(text, s); s != "" && i != -1 && (cut == -1 || i < cut) {
+			cut = i
+		}
+	}
+
+	return cut
+}
+
+// stopCutter ends streamed text at the first stop sequence, holding back the
+// text that may be the beginning of one.
+type stopCutter struct {
+	stop    []string
+	pending string
+	stopped bool
+}
+
+// Feed returns the text of the delta that may be sent and whether a stop sequence was reached.
+func (c *stopCutter) Feed(delta string) (string, bool) {
+	if c.stopped {
+		return "", true
+	}
+
+	buf := c.pending + delta
+
+	if i := stopIndex(buf, c.stop); i != -1 {
+		c.pending = ""
+		c.stopped = true
+
+		return buf[:i], true
+	}
+
+	keep := 0
+
+	for _, s := range c.stop {
+		keep = max(keep, partialTagSuffix(buf, s))
+	}
+
+	c.pending = buf[len(buf)-keep:]
+
+	return buf[:len(buf)-keep], false
+}
+
+// Flush returns the text held back at the end of the stream.
+func (c *stopCutter) Flush() string {
+	rest := c.pending
+	c.pending = ""
+
+	return rest
+}
+
+// streamCompletion streams a single completion, turning the chat deltas into
+// text_completion chunks as they arrive.
+func streamCompletion(ctx context.Context, w http.ResponseWriter, reqBodyBytes []byte, prompt string, stop []string, opts chatOptions) {
+	chatBody, err := completionToChat(reqBodyBytes, prompt)
+	if err == nil {
+		chatBody, err = sjson.SetBytes(chatBody, "stream", true)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	stream, err := routeStream(ctx, chatBody, opts)
+	if err != nil {
+		writeChatError(w, err)
+
+		return
+	}
+
+	defer stream.Close()
+
+	response := ResponseCompletion{
+		ID:      "cmpl-" + uuid.NewString(),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   stream.model.Name,
+	}
+
+	opts.context.writeHeaders(w)
+
+	if stream.upstream == nil {
+		// the provider cannot stream, its full answer is replayed
+		choice := gjson.GetBytes(stream.response, "choices.0")
+		text, finishReason := applyStop(choice.Get("message.content").String(), choice.Get("finish_reason").String(), stop)
+
+		response.Model = cmp.Or(gjson.GetBytes(stream.response, "model").String(), response.Model)
+		response.Choices = []CompletionChoice{{Text: text, FinishReason: &finishReason}}
+		writeCompletionStream(w, response)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	cutter := stopCutter{stop: stop}
+	finished := false
+
+	forwardChatStream(stream.upstream.Body, stream.model, opts, func(chunk []byte) bool {
+		response.Model = cmp.Or(gjson.GetBytes(chunk, "model").String(), response.Model)
+
+		choice := gjson.GetBytes(chunk, "choices.0")
+		text, stopped := cutter.Feed(choice.Get("delta.content").String())
+		finishReason := choice.Get("finish_reason").String()
+
+		if stopped {
+			finishReason = "stop"
+		} else if finishReason != "" {
+			text += cutter.Flush()
+		}
+
+		writeCompletionChunk(w, response, text, finishReason)
+		finished = finishReason != ""
+
+		return !stopped
+	})
+
+	// the stream ended without a finish_reason
+	if !finished {
+		writeCompletionChunk(w, response, cutter.Flush(), "stop")
+	}
+
+	writeSSEDone(w)
+}
+
+// writeCompletionChunk sends the text of the choice and, when it is given, the finish reason as separate chunks.
+func writeCompletionChunk(w http.ResponseWriter, response ResponseCompletion, text, finishReason string) {
+	if text != "" {
+		response.Choices = []CompletionChoice{{Text: text}}
+		writeSSE(w, response)
+	}
+
+	if finishReason != "" {
+		response.Choices = []CompletionChoice{{FinishReason: &finishReason}}
+		writeSSE(w, response)
+	}
+}
+
+// writeCompletionStream replays a finished completion as server-sent events,
+// one text chunk and one finish chunk per choice.
+func writeCompletionStream(w http.ResponseWriter, response ResponseCompletion) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for _, choice := range response.Choices {
+		chunk := response
+		chunk.Usage = nil
+
+		text := choice
+		text.FinishReason = nil
+
+		finish := choice
+		finish.Text = ""
+
+		for _, v := range []CompletionChoice{text, finish} {
+			chunk.Choices = []CompletionChoice{v}
+			writeSSE(w, chunk)
+		}
+	}
+
+	writeSSEDone(w)
+}
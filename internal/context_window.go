@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Overflow policies of a pool for requests longer than the context of its models.
+const (
+	OverflowTrim      = "trim"      // drop the oldest messages
+	OverflowSummarize = "summarize" // replace the oldest messages with a summary made by a SMALL model
+)
+
+const (
+	summaryMaxTokens = 512
+	summaryReserve   = summaryMaxTokens + 20 // the summary with its heading and message overhead
+	summaryPrompt    = "Summarize the conversation below in a few sentences. Keep names, facts, decisions and open questions. Answer with the summary only."
+)
+
+var errContextTooLong = errors.New("request does not fit any model even without old messages")
+
+// contextReport collects what was removed from the conversation for the response headers.
+type contextReport struct {
+	mu         sync.Mutex
+	trimmed    int
+	summarized int
+}
+
+func (r *contextReport) set(trimmed, summarized int) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.trimmed = trimmed
+	r.summarized = summarized
+}
+
+// writeHeaders reports the number of dropped and summarized messages.
+func (r *contextReport) writeHeaders(w http.ResponseWriter) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.trimmed > 0 {
+		w.Header().Set("X-Context-Trimmed", strconv.Itoa(r.trimmed))
+	}
+
+	if r.summarized > 0 {
+		w.Header().Set("X-Context-Summarized", strconv.Itoa(r.summarized))
+	}
+}
+
+// fitContext removes the oldest messages, keeping system messages and the last
+// one, until the request fits a model of the pool. With the summarize policy
+// the removed messages are replaced by their summary when it can be made.
+func fitContext(ctx context.Context, reqBodyBytes []byte, inPool func(Model) bool, policy string, report *contextReport) ([]byte, error) {
+	messages := gjson.GetBytes(reqBodyBytes, "messages").Array()
+
+	for count := 1; ; count++ {
+		kept, removed, ok := dropOldest(messages, count)
+		if !ok {
+			return nil, errContextTooLong
+		}
+
+		body, err := withMessages(reqBodyBytes, kept)
+		if err != nil {
+			return nil, err
+		}
+
+		size := newRequestSize(body)
+		if policy == OverflowSummarize {
+			size.reserve = summaryReserve
+		}
+
+		if !size.fitsAny(inPool) {
+			continue
+		}
+
+		if policy == OverflowSummarize {
+			summarized, err := addSummary(ctx, body, kept, removed)
+			if err == nil {
+				log.Printf("Summarized %d old messages to fit the context", len(removed))
+				report.set(0, len(removed))
+
+				return summarized, nil
+			}
+
+			log.Printf("Error summarizing old messages, dropping them: %v", err)
+		}
+
+		log.Printf("Dropped %d old messages to fit the context", len(removed))
+		report.set(len(removed), 0)
+
+		return body, nil
+	}
+}
+
+// dropOldest removes count messages other than system ones and the last message,
+// together with the tool results of removed tool calls.
+func dropOldest(messages []gjson.Result, count int) ([]gjson.Result, []gjson.Result, bool) {
+	var kept, removed []gjson.Result
+
+	for i, message := range messages {
+		role := message.Get("role").String()
+
+		switch {
+		case role == "system" || role == "developer" || i == len(messages)-1:
+			kept = append(kept, message)
+		case count > 0:
+			removed = append(removed, message)
+			count--
+		case role == "tool" && len(removed) > 0 && len(kept) == leadingSystem(kept):
+			// result of a removed tool call
+			removed = append(removed, message)
+		default:
+			kept = append(kept, message)
+		}
+	}
+
+	return kept, removed, count == 0
+}
+
+// leadingSystem returns the number of system messages at the start of messages.
+func leadingSystem(messages []gjson.Result) int {
+	for i, message := range messages {
+		if role := message.Get("role").String(); role != "system" && role != "developer" {
+			return i
+		}
+	}
+
+	return len(messages)
+}
+
+func withMessages(reqBodyBytes []byte, messages []gjson.Result) ([]byte, error) {
+	raw := make([]string, 0, len(messages))
+
+	for _, message := range messages {
+		raw = append(raw, message.Raw)
+	}
+
+	body, err := sjson.SetRawBytes(reqBodyBytes, "messages", []byte("["+strings.Join(raw, ",")+"]"))
+	if err != nil {
+		return nil, fmt.Errorf("error in sjson.SetRawBytes: %w", err)
+	}
+
+	return body, nil
+}
+
+// addSummary asks a SMALL model to summarize the removed messages and inserts the
+// summary after the leading system messages.
+func addSummary(ctx context.Context, reqBodyBytes []byte, kept, removed []gjson.Result) ([]byte, error) {
+	var transcript strings.Builder
+
+	for _, message := range removed {
+		fmt.Fprintf(&transcript, "%s: %s\n", message.Get("role").String(), messageText(message.Get("content")))
+	}
+
+	request, err := json.Marshal(map[string]any{
+		"model":      "SMALL",
+		"max_tokens": summaryMaxTokens,
+		"messages": []map[string]string{
+			{"role": "system", "content": summaryPrompt},
+			{"role": "user", "content": transcript.String()},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := completeOne(ctx, request, chatOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	summary := strings.TrimSpace(gjson.GetBytes(response, "choices.0.message.content").String())
+	if summary == "" {
+		return nil, errors.New("empty summary")
+	}
+
+	index := leadingSystem(kept)
+
+	message, err := sjson.SetBytes([]byte(`{"role":"system"}`), "content", "Summary of the earlier conversation:\n"+summary)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := append(append(kept[:index:index], gjson.ParseBytes(message)), kept[index:]...)
+
+	return withMessages(reqBodyBytes, messages)
+}
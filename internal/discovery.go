@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"ai-proxy/internal/httpclient"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	defaultDiscoveryInterval = time.Hour
+	discoveryTimeout         = 30 * time.Second
+)
+
+// DiscoveryConfig turns on model discovery for a provider: the models of its
+// catalog matching the patterns are registered and dropped once retired.
+type DiscoveryConfig struct {
+	URL      string        `yaml:"url"`      // catalog, the models list under the provider url by default
+	Interval time.Duration `yaml:"interval"` // between refreshes, 1h by default
+	Include  []string      `yaml:"include"`  // id patterns, * matches anything, e.g. *:free; all models if empty
+	Exclude  []string      `yaml:"exclude"`
+	Model    Model         `yaml:"model"` // fields of the discovered models, the rest comes from the provider
+}
+
+// contextPaths are the catalog fields holding the context length, by provider.
+var contextPaths = []string{"context_length", "context_window", "top_provider.context_length", "limits.max_input_tokens"}
+
+var (
+	discovered   = make(map[string][]string) // provider -> names of the models it registered
+	discoveredMu sync.Mutex
+)
+
+// DiscoverModels fetches the catalogs of the providers with discovery now and
+// then keeps them up to date in the background.
+func DiscoverModels(providers map[string]ProviderConfig) {
+	for name, provider := range providers {
+		if provider.Discovery == nil {
+			continue
+		}
+
+		discoverProvider(name, provider)
+
+		go func() {
+			for {
+				time.Sleep(cmp.Or(provider.Discovery.Interval, defaultDiscoveryInterval))
+				discoverProvider(name, provider)
+			}
+		}()
+	}
+}
+
+func discoverProvider(name string, provider ProviderConfig) {
+	ids, err := fetchCatalog(provider)
+	if err != nil {
+		log.Printf("Error in model discovery of %s: %v", name, err)
+
+		return
+	}
+
+	discoveredMu.Lock()
+	defer discoveredMu.Unlock()
+
+	var names []string
+
+	for _, item := range ids {
+		id := item.Get("id").String()
+		if id == "" || item.Get("active").Exists() && !item.Get("active").Bool() || !discoveryMatches(provider.Discovery, id) {
+			continue
+		}
+
+		model := provider.Discovery.Model
+		model.Name = name + "/" + id
+		model.Provider = name
+		model.Type = cmp.Or(model.Type, ModelTypeChat)
+
+		// without a size a discovered chat model would never join a pool
+		if model.Type == ModelTypeChat {
+			model.Size = cmp.Or(model.Size, "SMALL")
+		}
+
+		for _, path := range contextPaths {
+			if length := item.Get(path).Int(); length > 0 {
+				model.ContextWindow = int(length)
+
+				break
+			}
+		}
+
+		old, found := findModel(model.Name)
+
+		switch {
+		case found && !slices.Contains(discovered[name], model.Name):
+			continue // the models of the config win over discovered ones
+		case found:
+			// keep the changes made through the admin API
+			model.Disabled = old.Disabled
+			model.Priority = old.Priority
+		}
+
+		model, err = PrepareModel(model, map[string]ProviderConfig{name: provider})
+		if err != nil {
+			log.Printf("Skipped discovered model %s: %v", model.Name, err)
+
+			continue
+		}
+
+		if !slices.Contains(discovered[name], model.Name) {
+			log.Printf("Discovered %s model %s", model.Type, model.Name)
+		}
+
+		AddModel(model)
+
+		names = append(names, model.Name)
+	}
+
+	for _, old := range discovered[name] {
+		if !slices.Contains(names, old) && RemoveModel(old) {
+			log.Printf("Dropped retired model %s", old)
+		}
+	}
+
+	discovered[name] = names
+}
+
+// fetchCatalog returns the entries of the models list of the provider, either
+// an OpenAI style {"data": [...]} or a plain array.
+func fetchCatalog(provider ProviderConfig) ([]gjson.Result, error) {
+	listURL := provider.Discovery.URL
+	if listURL == "" {
+		listURL = strings.TrimSuffix(provider.URL, "/") + "/models"
+	}
+
+	token := provider.Token
+	if len(provider.Tokens) > 0 {
+		token = provider.Tokens[0]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(httpclient.WithHeaders(ctx, provider.Auth, provider.Headers), http.MethodGet, listURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	resp, err := httpclient.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpclient.StatusError{Code: resp.StatusCode}
+	}
+
+	list := gjson.ParseBytes(body)
+	if data := list.Get("data"); data.IsArray() {
+		list = data
+	}
+
+	if !list.IsArray() {
+		return nil, fmt.Errorf("unexpected models list: %.200s", body)
+	}
+
+	return list.Array(), nil
+}
+
+func discoveryMatches(cfg *DiscoveryConfig, id string) bool {
+	matches := func(patterns []string) bool {
+		return slices.ContainsFunc(patterns, func(pattern string) bool { return globPattern(pattern).MatchString(id) })
+	}
+
+	return (len(cfg.Include) == 0 || matches(cfg.Include)) && !matches(cfg.Exclude)
+}
+
+// globPattern compiles a pattern where * matches any run of characters, slashes included.
+func globPattern(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+}
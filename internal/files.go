@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"ai-proxy/internal/storage"
+)
+
+var (
+	// Files keeps generated images served by /files/{id}, nil when storage is disabled
+	Files       storage.Store
+	FilesConfig storage.Config
+
+	fileIDRegexp = regexp.MustCompile(`^[0-9a-f]{64}\.[a-z0-9]+$`)
+
+	fileExtensions = map[string]string{
+		"image/png":  ".png",
+		"image/jpeg": ".jpg",
+		"image/webp": ".webp",
+		"image/gif":  ".gif",
+	}
+)
+
+// saveFile stores data under its content hash and returns the file ID.
+func saveFile(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+
+	ext, ok := fileExtensions[http.DetectContentType(data)]
+	if !ok {
+		ext = ".bin"
+	}
+
+	id := hex.EncodeToString(sum[:]) + ext
+
+	return id, Files.Put(id, data)
+}
+
+// fileURL returns the public link to a stored file.
+func fileURL(req *http.Request, id string) string {
+	baseURL := FilesConfig.PublicURL
+	if baseURL == "" {
+		scheme := "http"
+		if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+
+		baseURL = scheme + "://" + req.Host
+	}
+
+	return strings.TrimSuffix(baseURL, "/") + "/files/" + id
+}
+
+func HandlerFile(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+
+	if Files == nil || !fileIDRegexp.MatchString(id) {
+		http.NotFound(w, req)
+
+		return
+	}
+
+	data, err := Files.Get(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.NotFound(w, req)
+
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error reading file %s: %v", id, err)
+		http.Error(w, "", http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", cmp.Or(mime.TypeByExtension(filepath.Ext(id)), "application/octet-stream"))
+	w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	w.Write(data)
+}
+
+// CleanupFiles periodically removes stored files older than the retention period.
+func CleanupFiles(retention time.Duration) {
+	interval := max(retention/4, time.Minute)
+
+	for {
+		removed, err := storage.Expire(Files, retention, fileIDRegexp.MatchString)
+		if err != nil {
+			log.Printf("Error expiring files: %v", err)
+		} else if removed > 0 {
+			log.Printf("Expired %d stored files", removed)
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -2,30 +2,36 @@ package gemini
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"time"
+	"strings"
 
+	"ai-proxy/internal/httpclient"
 	"ai-proxy/internal/schema"
 )
 
-var (
-	queue           = make(chan interface{}, 1)
-	lastTimeRequest = time.Now()
-
-	maxTimeoutTime = 10 * time.Second
-)
-
 type RequestAutoGenerated struct {
-	Contents []Contents `json:"contents,omitempty"`
+	Contents         []Contents        `json:"contents,omitempty"`
+	GenerationConfig *GenerationConfig `json:"generationConfig,omitempty"`
 	// SystemInstruction Contents   `json:"systemInstruction,omitempty"`
 }
 
+type GenerationConfig struct {
+	CandidateCount int `json:"candidateCount,omitempty"`
+}
+
 type Parts struct {
-	Text string `json:"text,omitempty"`
+	Text       string      `json:"text,omitempty"`
+	InlineData *InlineData `json:"inlineData,omitempty"`
+}
+
+type InlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"` // base64
 }
 
 type Contents struct {
@@ -60,39 +66,43 @@ type ResponceGenerated struct {
 	} `json:"error,omitempty"`
 }
 
-func CreateRequest(providerURL, model, token string, reqBody schema.RequestOpenAICompatable) (*http.Request, error) {
+func CreateRequest(ctx context.Context, providerURL, model, token string, reqBody schema.RequestOpenAICompatable) (*http.Request, error) {
 	var body RequestAutoGenerated
 
 	for _, v := range reqBody.Messages {
+		parts, err := contentParts(ctx, v.Content)
+		if err != nil {
+			return nil, err
+		}
+
 		switch v.Role {
 		// case "system":
 		// 	body.SystemInstruction = Contents{
 		// 		Role:  "user",
-		// 		Parts: []Parts{{Text: v.Content}},
+		// 		Parts: parts,
 		// 	}
 		case "system":
 			body.Contents = append(body.Contents, Contents{
 				Role:  "user",
-				Parts: []Parts{{Text: v.Content}},
-			})
-		case "user":
-			body.Contents = append(body.Contents, Contents{
-				Role:  v.Role,
-				Parts: []Parts{{Text: v.Content}},
+				Parts: parts,
 			})
 		case "assistant":
 			body.Contents = append(body.Contents, Contents{
 				Role:  "model",
-				Parts: []Parts{{Text: v.Content}},
+				Parts: parts,
 			})
 		default:
 			body.Contents = append(body.Contents, Contents{
 				Role:  v.Role,
-				Parts: []Parts{{Text: v.Content}},
+				Parts: parts,
 			})
 		}
 	}
 
+	if reqBody.N > 1 {
+		body.GenerationConfig = &GenerationConfig{CandidateCount: reqBody.N}
+	}
+
 	jsonBody, err := json.Marshal(body)
 	if err != nil {
 		return nil, err
@@ -102,37 +112,49 @@ func CreateRequest(providerURL, model, token string, reqBody schema.RequestOpenA
 
 	providerURL = fmt.Sprintf("%s/%s:generateContent?key=%s", providerURL, model, token)
 
-	return http.NewRequest(http.MethodPost, providerURL, bytes.NewReader(jsonBody))
+	return http.NewRequestWithContext(ctx, http.MethodPost, providerURL, bytes.NewReader(jsonBody))
 }
 
-func Call(providerURL, model, token string, reqBody []byte) ([]byte, error) {
-	var requestBody schema.RequestOpenAICompatable
+// contentParts converts OpenAI content parts, images and audio are sent inline.
+func contentParts(ctx context.Context, content schema.Content) ([]Parts, error) {
+	if content.Parts == nil {
+		return []Parts{{Text: content.Text}}, nil
+	}
 
-	err := json.Unmarshal(reqBody, &requestBody)
-	if err != nil {
-		return nil, fmt.Errorf("error in json.Unmarshal: %w", err)
+	var parts []Parts
+
+	for _, v := range content.Parts {
+		if v.Type == "text" {
+			parts = append(parts, Parts{Text: v.Text})
+
+			continue
+		}
+
+		mimeType, data, err := v.Data(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		parts = append(parts, Parts{InlineData: &InlineData{MimeType: mimeType, Data: base64.StdEncoding.EncodeToString(data)}})
 	}
 
-	// Выполняем запросы в 1 поток
-	queue <- struct{}{}
-	defer func() {
-		// Запоминаем время последнего запроса и очищаем очередь
-		lastTimeRequest = time.Now()
+	return parts, nil
+}
 
-		<-queue
-	}()
+func Call(ctx context.Context, providerURL, model, token string, reqBody []byte) ([]byte, error) {
+	var requestBody schema.RequestOpenAICompatable
 
-	if !time.Now().After(lastTimeRequest.Add(maxTimeoutTime)) {
-		log.Printf("Throttled %v seс for %s", time.Until(lastTimeRequest.Add(maxTimeoutTime)).Seconds(), model)
-		time.Sleep(time.Until(lastTimeRequest.Add(maxTimeoutTime)))
+	err := json.Unmarshal(reqBody, &requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("error in json.Unmarshal: %w", err)
 	}
 
-	req, err := CreateRequest(providerURL, model, token, requestBody)
+	req, err := CreateRequest(ctx, providerURL, model, token, requestBody)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpclient.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -145,7 +167,7 @@ func Call(providerURL, model, token string, reqBody []byte) ([]byte, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return body, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return body, &httpclient.StatusError{Code: resp.StatusCode}
 	}
 
 	var response ResponceGenerated
@@ -206,7 +228,13 @@ func transformResponse(response ResponceGenerated) ([]byte, error) {
 			ch.Message.Role = v.Content.Role
 		}
 
-		ch.Message.Content = v.Content.Parts[0].Text
+		var content strings.Builder
+
+		for _, part := range v.Content.Parts {
+			content.WriteString(part.Text)
+		}
+
+		ch.Message.Content = content.String()
 		ch.FinishReason = v.FinishReason
 
 		respTxt.Choices = append(respTxt.Choices, ch)
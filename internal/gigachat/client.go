@@ -1,68 +1,167 @@
 package gigachat
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"strings"
 	"time"
 
+	"ai-proxy/internal/httpclient"
+
 	"github.com/evgensoft/gigachat"
+	"github.com/google/uuid"
+	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
 
-var (
-	queue           = make(chan interface{}, 1)
-	lastTimeRequest = time.Now()
+const BaseURL = "https://gigachat.devices.sberbank.ru/api/v1"
 
-	maxTimeoutTime = 1 * time.Second
-	gigachatClient *gigachat.Client
-)
+var accessTokens = &tokenCache{fetch: fetchAccessToken}
+
+// ErrNotListed возвращается CheckModel, когда модели нет в списке /models.
+var ErrNotListed = errors.New("model is not in the models list")
 
-func InitClient(token string) error {
-	// Разбиваем строку на clientID и clientSecret
+// ParseToken разбивает токен модели на clientID и clientSecret.
+func ParseToken(token string) (string, string, error) {
 	parts := strings.SplitN(token, ":", 2)
 	if len(parts) != 2 {
-		return fmt.Errorf("error in strings.SplitN: %v parts", len(parts))
+		return "", "", fmt.Errorf("error in strings.SplitN: %v parts", len(parts))
 	}
 
-	clientID := parts[0]
-	clientSecret := parts[1]
+	return parts[0], parts[1], nil
+}
 
-	// Создаем клиент (по умолчанию используется ScopePersonal)
-	gigachatClient = gigachat.NewClient(clientID, clientSecret)
+func Call(ctx context.Context, providerURL, model, token string, requestBody []byte) ([]byte, error) {
+	reqBody, err := sjson.SetBytes(requestBody, "model", model)
+	if err != nil {
+		return nil, fmt.Errorf("error in sjson.SetBytes: %w", err)
+	}
 
-	// При необходимости можно изменить scope
-	gigachatClient.SetScope(gigachat.ScopeCorp)
+	// GigaChat принимает только строковый content, картинки передаются вложениями
+	reqBody, err = convertContent(ctx, token, reqBody)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	resp, err := send(ctx, cmp.Or(providerURL, BaseURL)+"/chat/completions", token, reqBody)
+	if err != nil {
+		return resp, err
+	}
+
+	log.Printf("Resp from Gigachat - %s", resp)
+
+	return ConvertGigaChatResponseToOpenAI(resp, model, true)
 }
 
-func Call(providerURL, model, token string, requestBody []byte) ([]byte, error) {
-	// Выполняем запросы в 1 поток
-	queue <- struct{}{}
-	defer func() {
-		// Запоминаем время последнего запроса и очищаем очередь
-		lastTimeRequest = time.Now()
+// send отправляет запрос в chat/completions с access token из кэша.
+func send(ctx context.Context, chatURL, token string, reqBody []byte) ([]byte, error) {
+	clientID, _, err := ParseToken(token)
+	if err != nil {
+		return nil, err
+	}
 
-		<-queue
-	}()
+	return withAccessToken(ctx, accessTokens, token, func(accessToken string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, chatURL, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
 
-	reqBody, err := sjson.SetBytes(requestBody, "model", model)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		req.Header.Set("X-Client-ID", clientID)
+		req.Header.Set("X-Request-ID", uuid.NewString())
+		req.Header.Set("X-Session-ID", uuid.NewString())
+
+		resp, err := httpclient.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return body, &httpclient.StatusError{Code: resp.StatusCode}
+		}
+
+		return body, nil
+	})
+}
+
+// fetchAccessToken получает новый access token для clientID:clientSecret.
+func fetchAccessToken(token string) (cachedToken, error) {
+	clientID, clientSecret, err := ParseToken(token)
 	if err != nil {
-		return nil, fmt.Errorf("error in sjson.SetBytes: %w", err)
+		return cachedToken{}, err
 	}
 
-	if !time.Now().After(lastTimeRequest.Add(maxTimeoutTime)) {
-		log.Printf("Throttled %v seс for %s", time.Until(lastTimeRequest.Add(maxTimeoutTime)).Seconds(), model)
-		time.Sleep(time.Until(lastTimeRequest.Add(maxTimeoutTime)))
+	// Клиент создается на каждый токен (по умолчанию используется ScopePersonal)
+	client := gigachat.NewClient(clientID, clientSecret)
+	client.SetScope(gigachat.ScopeCorp)
+
+	resp, err := client.GetToken()
+	if err != nil {
+		return cachedToken{}, fmt.Errorf("error getting GigaChat token: %w", err)
 	}
 
-	resp, err := gigachatClient.SendBytes(reqBody)
+	return cachedToken{
+		accessToken: resp.AccessToken,
+		expiry:      time.UnixMilli(resp.ExpiresAt).Add(-time.Minute),
+	}, nil
+}
+
+// ForgetToken удаляет access token для clientID:clientSecret из кэша.
+func ForgetToken(token string) {
+	accessTokens.forget(token)
+}
+
+// CheckModel проверяет токен и наличие модели в списке /models.
+func CheckModel(ctx context.Context, providerURL, model, token string) error {
+	body, err := withAccessToken(ctx, accessTokens, token, func(accessToken string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, cmp.Or(providerURL, BaseURL)+"/models", nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+
+		resp, err := httpclient.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, &httpclient.StatusError{Code: resp.StatusCode}
+		}
+
+		return body, nil
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	log.Printf("Resp from Gigachat - %s", resp)
+	for _, id := range gjson.GetBytes(body, "data.#.id").Array() {
+		if id.String() == model {
+			return nil
+		}
+	}
 
-	return ConvertGigaChatResponseToOpenAI(resp, model, true)
+	return fmt.Errorf("%w: %s", ErrNotListed, model)
 }
@@ -0,0 +1,148 @@
+package gigachat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+
+	"ai-proxy/internal/httpclient"
+	"ai-proxy/internal/schema"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const FilesURL = "https://gigachat.devices.sberbank.ru/api/v1/files"
+
+// convertContent заменяет массивы content parts текстом и вложениями,
+// загруженными в хранилище GigaChat.
+func convertContent(ctx context.Context, token string, requestBody []byte) ([]byte, error) {
+	var err error
+
+	for i, message := range gjson.GetBytes(requestBody, "messages").Array() {
+		if !message.Get("content").IsArray() {
+			continue
+		}
+
+		var content schema.Content
+
+		err = json.Unmarshal([]byte(message.Get("content").Raw), &content)
+		if err != nil {
+			return nil, fmt.Errorf("error in json.Unmarshal: %w", err)
+		}
+
+		var attachments []string
+
+		for _, part := range content.Parts {
+			if part.Type == "text" {
+				continue
+			}
+
+			mimeType, data, err := part.Data(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			id, err := uploadFile(ctx, token, mimeType, data)
+			if err != nil {
+				return nil, fmt.Errorf("error uploading file to GigaChat: %w", err)
+			}
+
+			attachments = append(attachments, id)
+		}
+
+		requestBody, err = sjson.SetBytes(requestBody, fmt.Sprintf("messages.%d.content", i), content.String())
+		if err != nil {
+			return nil, fmt.Errorf("error in sjson.SetBytes: %w", err)
+		}
+
+		if len(attachments) > 0 {
+			requestBody, err = sjson.SetBytes(requestBody, fmt.Sprintf("messages.%d.attachments", i), attachments)
+			if err != nil {
+				return nil, fmt.Errorf("error in sjson.SetBytes: %w", err)
+			}
+		}
+	}
+
+	return requestBody, nil
+}
+
+// uploadFile загружает файл и возвращает его id для поля attachments.
+func uploadFile(ctx context.Context, token, mimeType string, data []byte) (string, error) {
+	var body bytes.Buffer
+
+	writer := multipart.NewWriter(&body)
+
+	filename := "file"
+	if ext, _ := mime.ExtensionsByType(mimeType); len(ext) > 0 {
+		filename += ext[0]
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, filename))
+	header.Set("Content-Type", mimeType)
+
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = part.Write(data)
+	if err != nil {
+		return "", err
+	}
+
+	err = writer.WriteField("purpose", "general")
+	if err != nil {
+		return "", err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return "", err
+	}
+
+	respBody, err := withAccessToken(ctx, accessTokens, token, func(accessToken string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, FilesURL, bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+
+		resp, err := httpclient.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		defer resp.Body.Close()
+
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%w, body: %s", &httpclient.StatusError{Code: resp.StatusCode}, respBody)
+		}
+
+		return respBody, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	id := gjson.GetBytes(respBody, "id").String()
+	if id == "" {
+		return "", fmt.Errorf("no file id in response: %s", respBody)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,119 @@
+package gigachat
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"ai-proxy/internal/httpclient"
+
+	"github.com/evgensoft/gigachat"
+)
+
+const (
+	SaluteSpeechURL    = "https://smartspeech.sber.ru/rest/v1/text:synthesize"
+	saluteScope        = "SALUTE_SPEECH_PERS"
+	saluteDefaultVoice = "May_24000"
+)
+
+// Форматы SaluteSpeech для форматов OpenAI
+var saluteFormats = map[string]string{
+	"wav":  "wav16",
+	"opus": "opus",
+	"pcm":  "pcm16",
+}
+
+var saluteTokens = &tokenCache{fetch: fetchSaluteToken}
+
+// SaluteFormat returns the SaluteSpeech format for an OpenAI response_format.
+func SaluteFormat(format string) (string, bool) {
+	res, ok := saluteFormats[format]
+
+	return res, ok
+}
+
+// Synthesize озвучивает текст через SaluteSpeech.
+// token: clientID:clientSecret[:scope], scope по умолчанию SALUTE_SPEECH_PERS.
+func Synthesize(ctx context.Context, providerURL, token, text, voice, format string) (*http.Response, error) {
+	saluteFormat, ok := SaluteFormat(format)
+	if !ok {
+		return nil, fmt.Errorf("unsupported response_format %q", format)
+	}
+
+	// Голоса SaluteSpeech имеют вид Nec_24000, остальные заменяем голосом по умолчанию
+	if !strings.Contains(voice, "_") {
+		voice = saluteDefaultVoice
+	}
+
+	params := url.Values{}
+	params.Add("format", saluteFormat)
+	params.Add("voice", voice)
+
+	if providerURL == "" {
+		providerURL = SaluteSpeechURL
+	}
+
+	return withAccessToken(ctx, saluteTokens, token, func(accessToken string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, providerURL+"?"+params.Encode(), bytes.NewBufferString(text))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/text")
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+
+		resp, err := httpclient.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+
+			return nil, fmt.Errorf("%w, body: %s", &httpclient.StatusError{Code: resp.StatusCode}, body)
+		}
+
+		return resp, nil
+	})
+}
+
+// fetchSaluteToken получает новый access token (живет 30 мин).
+func fetchSaluteToken(token string) (cachedToken, error) {
+	parts := strings.SplitN(token, ":", 3)
+	if len(parts) < 2 {
+		return cachedToken{}, fmt.Errorf("error in strings.SplitN: %v parts", len(parts))
+	}
+
+	client := gigachat.NewClient(parts[0], parts[1])
+
+	scope := saluteScope
+	if len(parts) == 3 {
+		scope = parts[2]
+	}
+
+	client.SetScope(scope)
+
+	resp, err := client.GetToken()
+	if err != nil {
+		return cachedToken{}, fmt.Errorf("error getting SaluteSpeech token: %w", err)
+	}
+
+	return cachedToken{
+		accessToken: resp.AccessToken,
+		expiry:      time.UnixMilli(resp.ExpiresAt).Add(-time.Minute),
+	}, nil
+}
+
+// CheckSaluteToken проверяет, что по clientID:clientSecret выдается access token.
+func CheckSaluteToken(ctx context.Context, token string) error {
+	_, err := saluteTokens.get(ctx, token)
+
+	return err
+}
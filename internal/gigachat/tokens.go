@@ -0,0 +1,149 @@
+package gigachat
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"ai-proxy/internal/httpclient"
+)
+
+type cachedToken struct {
+	accessToken string
+	expiry      time.Time
+}
+
+// tokenCache хранит access token по строке clientID:clientSecret. Новый токен
+// для ключа запрашивает только один запрос, остальные ключи при этом не ждут.
+type tokenCache struct {
+	mu       sync.Mutex
+	tokens   map[string]cachedToken
+	requests map[string]chan struct{} // занят, пока для ключа запрашивается токен
+	fetch    func(token string) (cachedToken, error)
+}
+
+type fetchResult struct {
+	accessToken string
+	err         error
+}
+
+func (c *tokenCache) cached(token string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.tokens[token]
+	if !ok || !time.Now().Before(cached.expiry) {
+		return "", false
+	}
+
+	return cached.accessToken, true
+}
+
+// get возвращает access token из кэша или получает новый. Запрос токена не
+// принимает ctx, поэтому при отмене ctx он доделывается в фоне и кэшируется.
+func (c *tokenCache) get(ctx context.Context, token string) (string, error) {
+	if accessToken, ok := c.cached(token); ok {
+		return accessToken, nil
+	}
+
+	c.mu.Lock()
+
+	if c.requests == nil {
+		c.requests = make(map[string]chan struct{})
+	}
+
+	request, ok := c.requests[token]
+	if !ok {
+		request = make(chan struct{}, 1)
+		c.requests[token] = request
+	}
+
+	c.mu.Unlock()
+
+	select {
+	case request <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	// токен мог получить запрос, который занимал ключ до нас
+	if accessToken, ok := c.cached(token); ok {
+		<-request
+
+		return accessToken, nil
+	}
+
+	result := make(chan fetchResult, 1)
+
+	go func() {
+		defer func() { <-request }()
+
+		fetched, err := c.fetch(token)
+		if err == nil {
+			c.mu.Lock()
+
+			if c.tokens == nil {
+				c.tokens = make(map[string]cachedToken)
+			}
+
+			c.tokens[token] = fetched
+			c.mu.Unlock()
+		}
+
+		result <- fetchResult{accessToken: fetched.accessToken, err: err}
+	}()
+
+	select {
+	case res := <-result:
+		return res.accessToken, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// forget удаляет токен ключа из кэша.
+func (c *tokenCache) forget(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.tokens, token)
+	delete(c.requests, token)
+}
+
+// expire удаляет accessToken, отклоненный провайдером, если его еще не заменил новый.
+func (c *tokenCache) expire(token, accessToken string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tokens[token].accessToken == accessToken {
+		delete(c.tokens, token)
+	}
+}
+
+// withAccessToken вызывает call с access token ключа. Если провайдер ответил 401,
+// токен мог быть отозван до истечения срока: получаем новый и повторяем один раз.
+func withAccessToken[T any](ctx context.Context, c *tokenCache, token string, call func(accessToken string) (T, error)) (T, error) {
+	accessToken, err := c.get(ctx, token)
+	if err != nil {
+		var zero T
+
+		return zero, err
+	}
+
+	res, err := call(accessToken)
+	if httpclient.StatusCode(err) != http.StatusUnauthorized {
+		return res, err
+	}
+
+	c.expire(token, accessToken)
+
+	accessToken, err = c.get(ctx, token)
+	if err != nil {
+		var zero T
+
+		return zero, err
+	}
+
+	return call(accessToken)
+}
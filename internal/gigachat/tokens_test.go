@@ -0,0 +1,106 @@
+package gigachat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ai-proxy/internal/httpclient"
+)
+
+func TestTokenCacheFetchesOncePerKey(t *testing.T) {
+	var fetches atomic.Int32
+
+	release := make(chan struct{})
+
+	cache := &tokenCache{fetch: func(token string) (cachedToken, error) {
+		fetches.Add(1)
+
+		if token == "slow" {
+			<-release
+		}
+
+		return cachedToken{accessToken: "access-" + token, expiry: time.Now().Add(time.Hour)}, nil
+	}}
+
+	var wg sync.WaitGroup
+
+	for range 5 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if accessToken, err := cache.get(context.Background(), "slow"); err != nil || accessToken != "access-slow" {
+				t.Errorf("get = %q, %v", accessToken, err)
+			}
+		}()
+	}
+
+	// another key is not held up by the slow one
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := cache.get(ctx, "fast"); err != nil {
+		t.Fatalf("get of another key: %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("%d fetches, want one per key", n)
+	}
+}
+
+func TestTokenCacheHonoursContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	cache := &tokenCache{fetch: func(string) (cachedToken, error) {
+		<-release
+
+		return cachedToken{accessToken: "access", expiry: time.Now().Add(time.Hour)}, nil
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := cache.get(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("get = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestWithAccessTokenRetriesUnauthorized(t *testing.T) {
+	var fetches atomic.Int32
+
+	cache := &tokenCache{fetch: func(string) (cachedToken, error) {
+		n := fetches.Add(1)
+
+		return cachedToken{accessToken: fmt.Sprint("access-", n), expiry: time.Now().Add(time.Hour)}, nil
+	}}
+
+	var used []string
+
+	res, err := withAccessToken(context.Background(), cache, "key", func(accessToken string) (string, error) {
+		used = append(used, accessToken)
+
+		if accessToken == "access-1" {
+			return "", &httpclient.StatusError{Code: http.StatusUnauthorized}
+		}
+
+		return "ok", nil
+	})
+	if err != nil || res != "ok" {
+		t.Fatalf("withAccessToken = %q, %v", res, err)
+	}
+
+	if len(used) != 2 || used[1] != "access-2" {
+		t.Errorf("access tokens used: %q, want a retry with a new one", used)
+	}
+}
@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"ai-proxy/internal/gigachat"
+	"ai-proxy/internal/httpclient"
+
+	"github.com/tidwall/gjson"
+)
+
+type HealthCheckConfig struct {
+	Interval  time.Duration `yaml:"interval"`   // 0 disables the checks
+	Timeout   time.Duration `yaml:"timeout"`    // per model, 30s by default
+	ChatProbe bool          `yaml:"chat_probe"` // send a one token request to chat models without a models list
+}
+
+const (
+	HealthUnknown   = "unknown" // not checked yet or no cheap probe for the provider
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+type ModelHealth struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Latency   int64     `json:"latency_ms,omitempty"`
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+}
+
+var (
+	errNoProbe      = errors.New("no health probe for this provider")
+	errProbeSkipped = errors.New("no quota left for a probe request")
+	errNotListed    = errors.New("model is not in the models list")
+)
+
+var (
+	health   = make(map[string]ModelHealth)
+	healthMu sync.RWMutex
+)
+
+// OpenAI compatible endpoints, the models list lives next to them
+var openAIPaths = []string{"/chat/completions", "/completions", "/embeddings", "/audio/", "/images/", "/responses"}
+
+// probeBody is the chat request for providers without a models list.
+var probeBody = []byte(`{"messages":[{"role":"user","content":"ping"}],"max_tokens":1}`)
+
+// CheckHealth periodically probes every model and takes unhealthy ones out of the pools.
+func CheckHealth(cfg HealthCheckConfig) {
+	for {
+		checkModels(cmp.Or(cfg.Timeout, 30*time.Second), cfg.ChatProbe)
+
+		time.Sleep(cfg.Interval)
+	}
+}
+
+func checkModels(timeout time.Duration, chatProbe bool) {
+	var wg sync.WaitGroup
+
+	for _, model := range ModelList() {
+		if model.Disabled {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(providerContext(context.Background(), model), timeout)
+			defer cancel()
+
+			start := time.Now()
+
+			err := probeModel(ctx, model, chatProbe)
+			if errors.Is(err, errProbeSkipped) {
+				return // the last result stands
+			}
+
+			setHealth(model, err, time.Since(start))
+		}()
+	}
+
+	wg.Wait()
+}
+
+func setHealth(model Model, err error, latency time.Duration) {
+	res := ModelHealth{Name: model.Name, Type: model.Type, Status: HealthHealthy, CheckedAt: time.Now()}
+
+	switch {
+	case errors.Is(err, errNoProbe):
+		res.Status = HealthUnknown
+	case err != nil:
+		res.Status = HealthUnhealthy
+		res.Error = err.Error()
+	default:
+		res.Latency = latency.Milliseconds()
+	}
+
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	if prev := health[model.Name]; prev.Status != res.Status {
+		switch res.Status {
+		case HealthUnhealthy:
+			log.Printf("Model %s is unhealthy: %s", model.Name, res.Error)
+		case HealthHealthy:
+			log.Printf("Model %s is healthy", model.Name)
+		}
+	}
+
+	health[model.Name] = res
+}
+
+// isHealthy reports whether the model passed its last check; unchecked models count as healthy.
+func isHealthy(modelName string) bool {
+	healthMu.RLock()
+	defer healthMu.RUnlock()
+
+	return health[modelName].Status != HealthUnhealthy
+}
+
+// probeModel asks the provider for its models list when it has one. With chatProbe
+// other chat models get a one token request, counted against their limits and
+// skipped when they have no quota left for it.
+func probeModel(ctx context.Context, model Model, chatProbe bool) error {
+	switch {
+	case model.Provider == "gigachat":
+		return listingError(gigachat.CheckModel(ctx, model.URL, providerModelName(model), model.Token))
+	case model.Provider == "salute":
+		return gigachat.CheckSaluteToken(ctx, model.Token)
+	case strings.Contains(model.URL, "/ai/run/"):
+		// Workers AI: the account models search
+		account, modelID, _ := strings.Cut(model.URL, "/ai/run/")
+
+		return listingError(checkModelsList(ctx, account+"/ai/models/search?search="+url.QueryEscape(modelID), model.Token, "result.#.name", modelID))
+	}
+
+	for _, path := range openAIPaths {
+		if base, _, ok := strings.Cut(model.URL, path); ok {
+			return listingError(checkModelsList(ctx, base+"/models", model.Token, "data.#.id", providerModelName(model)))
+		}
+	}
+
+	if !chatProbe || model.Type != ModelTypeChat {
+		return errNoProbe
+	}
+
+	if _, ok := tokenWithQuota(model, time.Now()); !ok {
+		return errProbeSkipped
+	}
+
+	// sendRequestToLLM counts the probe like any request
+	_, err := sendRequestToLLM(ctx, model.Name, probeBody, chatOptions{context: &contextReport{}})
+
+	return err
+}
+
+// checkModelsList checks the token and, when the list names models, that modelID is among them.
+func checkModelsList(ctx context.Context, listURL, token, path, modelID string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listURL, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	resp, err := httpclient.Client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return &httpclient.StatusError{Code: resp.StatusCode}
+	}
+
+	ids := gjson.GetBytes(body, path).Array()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	for _, id := range ids {
+		if id.String() == modelID {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", errNotListed, modelID)
+}
+
+// listingError keeps the results of a models list check that say the model is
+// down: network errors, timeouts, 5xx and rejected tokens. A rate limited
+// token still works, and a provider without a usable listing, or one that
+// leaves the model out, says nothing about the model.
+func listingError(err error) error {
+	code := httpclient.StatusCode(err)
+
+	switch {
+	case err == nil || code == http.StatusTooManyRequests:
+		return nil
+	case errors.Is(err, errNotListed) || errors.Is(err, gigachat.ErrNotListed):
+		return fmt.Errorf("%w: %w", errNoProbe, err)
+	case code >= 400 && code < 500 && code != http.StatusUnauthorized && code != http.StatusForbidden:
+		return fmt.Errorf("%w: %w", errNoProbe, err)
+	}
+
+	return err
+}
+
+// HandlerHealth reports the last check of every model; 503 when none of the checked models is healthy.
+func HandlerHealth(w http.ResponseWriter, req *http.Request) {
+	var response struct {
+		Status string        `json:"status"`
+		Models []ModelHealth `json:"models"`
+	}
+
+	response.Status = "ok"
+	checked, healthy := 0, 0
+
+	healthMu.RLock()
+
+	for _, model := range ModelList() {
+		res, ok := health[model.Name]
+		if !ok {
+			res = ModelHealth{Name: model.Name, Type: model.Type, Status: HealthUnknown}
+		}
+
+		switch res.Status {
+		case HealthHealthy:
+			checked++
+			healthy++
+		case HealthUnhealthy:
+			checked++
+			response.Status = "degraded"
+		}
+
+		response.Models = append(response.Models, res)
+	}
+
+	healthMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if checked > 0 && healthy == 0 {
+		response.Status = "down"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProbeModelsList(t *testing.T) {
+	status := http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/models" {
+			t.Errorf("unexpected probe of %s", req.URL.Path)
+		}
+
+		w.WriteHeader(status)
+		w.Write([]byte(`{"data":[{"id":"llama"},{"id":"mistral"}]}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		model     string
+		status    int
+		wantErr   bool
+		wantProbe bool
+	}{
+		{"listed", "llama", http.StatusOK, false, true},
+		{"not listed", "gone", http.StatusOK, true, false},
+		{"no listing", "llama", http.StatusNotFound, true, false},
+		{"bad token", "llama", http.StatusUnauthorized, true, true},
+		{"forbidden", "llama", http.StatusForbidden, true, true},
+		{"provider down", "llama", http.StatusBadGateway, true, true},
+		{"rate limited", "llama", http.StatusTooManyRequests, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status = tt.status
+			model := Model{Name: "p/" + tt.model, Type: ModelTypeChat, Provider: "p", URL: server.URL + "/v1/chat/completions"}
+
+			err := probeModel(context.Background(), model, false)
+			if (err != nil) != tt.wantErr || errors.Is(err, errNoProbe) == tt.wantProbe {
+				t.Errorf("probeModel error %v, want error %v, probe %v", err, tt.wantErr, tt.wantProbe)
+			}
+		})
+	}
+}
+
+func TestProbeChatModel(t *testing.T) {
+	model := testModel("p/a", "p")
+	model.URL = "http://127.0.0.1:1/v2/chat"
+	useModels(t, model)
+
+	if err := probeModel(context.Background(), model, false); !errors.Is(err, errNoProbe) {
+		t.Errorf("probe without chat_probe: %v, want errNoProbe", err)
+	}
+
+	for _, limit := range modelRateLimits(model.Name) {
+		limit.minuteCount = model.RequestsPerMin
+		limit.lastMinute = time.Now()
+	}
+
+	if err := probeModel(context.Background(), model, true); !errors.Is(err, errProbeSkipped) {
+		t.Errorf("probe without quota: %v, want errProbeSkipped", err)
+	}
+}
+
+func TestSetHealth(t *testing.T) {
+	model := testModel("p/a", "p")
+
+	healthMu.Lock()
+	prev := health
+	health = make(map[string]ModelHealth)
+	healthMu.Unlock()
+
+	t.Cleanup(func() {
+		healthMu.Lock()
+		health = prev
+		healthMu.Unlock()
+	})
+
+	steps := []struct {
+		err     error
+		status  string
+		healthy bool
+	}{
+		{nil, HealthHealthy, true},
+		{errors.New("unexpected status code: 404"), HealthUnhealthy, false},
+		{errNoProbe, HealthUnknown, true},
+		{errors.New("timeout"), HealthUnhealthy, false},
+		{nil, HealthHealthy, true},
+	}
+
+	if !isHealthy(model.Name) {
+		t.Fatal("an unchecked model must count as healthy")
+	}
+
+	for i, step := range steps {
+		setHealth(model, step.err, time.Millisecond)
+
+		healthMu.RLock()
+		res := health[model.Name]
+		healthMu.RUnlock()
+
+		if res.Status != step.status || isHealthy(model.Name) != step.healthy {
+			t.Errorf("step %d: status %s, healthy %v; want %s, %v", i, res.Status, isHealthy(model.Name), step.status, step.healthy)
+		}
+	}
+}
+
+func TestHandlerHealth(t *testing.T) {
+	a, b := testModel("p/a", "p"), testModel("p/b", "p")
+	useModels(t, a, b)
+
+	healthMu.Lock()
+	prev := health
+	health = make(map[string]ModelHealth)
+	healthMu.Unlock()
+
+	t.Cleanup(func() {
+		healthMu.Lock()
+		health = prev
+		healthMu.Unlock()
+	})
+
+	get := func() int {
+		w := httptest.NewRecorder()
+		HandlerHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+		return w.Code
+	}
+
+	if code := get(); code != http.StatusOK {
+		t.Errorf("unchecked models: %d, want 200", code)
+	}
+
+	setHealth(a, errors.New("down"), 0)
+	setHealth(b, nil, 0)
+
+	if code := get(); code != http.StatusOK {
+		t.Errorf("one healthy model: %d, want 200", code)
+	}
+
+	setHealth(b, errors.New("down"), 0)
+
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("no healthy model: %d, want 503", code)
+	}
+}
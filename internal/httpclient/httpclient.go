@@ -0,0 +1,174 @@
+// Package httpclient provides the HTTP client shared by all provider calls, with
+// connection pooling, HTTP/2 and a connect timeout, auth style and headers that
+// can be set per request.
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultConnectTimeout = 10 * time.Second
+	keepAlive             = 30 * time.Second
+)
+
+// Auth styles of a provider; any other value is the header that carries the token as is.
+const (
+	AuthBearer = "bearer" // Authorization: Bearer <token>, the default
+	AuthNone   = "none"   // no Authorization header
+)
+
+type (
+	connectTimeoutKey struct{}
+	headersKey        struct{}
+)
+
+type requestHeaders struct {
+	auth    string
+	headers map[string]string
+}
+
+var transport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           dialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          200,
+	MaxIdleConnsPerHost:   20,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: time.Second,
+}
+
+// Client has no overall timeout, requests are limited by their context.
+var Client = &http.Client{Transport: headerTransport{base: transport}}
+
+// Public fetches URLs that come from users, like images linked in messages. It
+// goes around the headers set with WithHeaders and the proxy from the
+// environment, and refuses to connect to loopback, private and link-local
+// addresses, which covers the targets of redirects too.
+var Public = &http.Client{Transport: &http.Transport{
+	DialContext:           publicDialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          20,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: time.Second,
+}}
+
+// ErrForbiddenAddress is returned by Public for a URL that resolves to an internal address.
+var ErrForbiddenAddress = errors.New("address is not public")
+
+// Transport returns the shared transport for clients that need their own settings.
+func Transport() http.RoundTripper {
+	return transport
+}
+
+// WithConnectTimeout sets the timeout of new connections made for requests with ctx.
+func WithConnectTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, connectTimeoutKey{}, timeout)
+}
+
+// WithHeaders sets the auth style and the extra headers of requests made with ctx.
+func WithHeaders(ctx context.Context, auth string, headers map[string]string) context.Context {
+	if (auth == "" || auth == AuthBearer) && len(headers) == 0 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, headersKey{}, requestHeaders{auth: auth, headers: headers})
+}
+
+// headerTransport adds the headers set with WithHeaders and moves the bearer
+// token set by the provider clients to where the provider expects it.
+type headerTransport struct {
+	base http.RoundTripper
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h, ok := req.Context().Value(headersKey{}).(requestHeaders)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+
+	for key, value := range h.headers {
+		req.Header.Set(key, value)
+	}
+
+	switch h.auth {
+	case "", AuthBearer:
+	case AuthNone:
+		req.Header.Del("Authorization")
+	default:
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+		req.Header.Del("Authorization")
+		req.Header.Set(h.auth, token)
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeout, ok := ctx.Value(connectTimeoutKey{}).(time.Duration)
+	if !ok || timeout <= 0 {
+		timeout = DefaultConnectTimeout
+	}
+
+	dialer := net.Dialer{Timeout: timeout, KeepAlive: keepAlive}
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func publicDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeout, ok := ctx.Value(connectTimeoutKey{}).(time.Duration)
+	if !ok || timeout <= 0 {
+		timeout = DefaultConnectTimeout
+	}
+
+	// Control runs after the name is resolved, for every address tried
+	dialer := net.Dialer{Timeout: timeout, KeepAlive: keepAlive, Control: checkPublic}
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func checkPublic(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := addrPort.Addr().Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, ip)
+	}
+
+	return nil
+}
+
+// StatusError is returned for a provider response with an unexpected status code.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.Code)
+}
+
+// StatusCode returns the code of the StatusError in the chain of err, 0 if there is none.
+func StatusCode(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code
+	}
+
+	return 0
+}
@@ -3,8 +3,10 @@ package internal
 import (
 	"bytes"
 	"cmp"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,6 +14,8 @@ import (
 	"net/url"
 	"strings"
 
+	"ai-proxy/internal/httpclient"
+
 	"github.com/tidwall/gjson"
 )
 
@@ -19,17 +23,70 @@ import (
 // curl https://ai-proxy-evgensoft.koyeb.app/image -d '{"model": "huggingface/black-forest-labs/FLUX.1-dev", "prompt": "Cat sleep on the moon"}'
 
 type RequestGenerateImage struct {
-	Model  string `json:"model,omitempty"`
-	Prompt string `json:"prompt,omitempty"`
-	Inputs string `json:"inputs,omitempty"`
+	Model          string `json:"model,omitempty"`
+	Prompt         string `json:"prompt,omitempty"`
+	Inputs         string `json:"inputs,omitempty"`
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	Size           string `json:"size,omitempty"`
+	Width          int    `json:"width,omitempty"`
+	Height         int    `json:"height,omitempty"`
+	Steps          int    `json:"steps,omitempty"`
+	Seed           int64  `json:"seed,omitempty"`
+	ResponseFormat string `json:"response_format,omitempty"` // url or b64_json, raw image bytes when empty
+}
+
+// ImageParams is a provider independent image generation request.
+type ImageParams struct {
+	Prompt         string
+	NegativePrompt string
+	Width          int
+	Height         int
+	Steps          int
+	Seed           int64
+	Image          []byte // source image for edits and variations
+	Mask           []byte // inpainting mask, transparent or white areas are repainted
+}
+
+type HuggingFaceRequestGenerateImage struct {
+	Inputs     string                 `json:"inputs"`
+	Parameters *HuggingFaceParameters `json:"parameters,omitempty"`
+}
+
+type HuggingFaceParameters struct {
+	Prompt            string `json:"prompt,omitempty"`
+	NegativePrompt    string `json:"negative_prompt,omitempty"`
+	Width             int    `json:"width,omitempty"`
+	Height            int    `json:"height,omitempty"`
+	NumInferenceSteps int    `json:"num_inference_steps,omitempty"`
+	Seed              int64  `json:"seed,omitempty"`
 }
 
 type TogetherRequestGenerateImage struct {
 	Model          string `json:"model"`
 	Prompt         string `json:"prompt"`
 	ResponseFormat string `json:"response_format"`
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	Width          int    `json:"width,omitempty"`
+	Height         int    `json:"height,omitempty"`
+	Steps          int    `json:"steps,omitempty"`
+	Seed           int64  `json:"seed,omitempty"`
+	ImageURL       string `json:"image_url,omitempty"`
 }
 
+type CloudflareRequestGenerateImage struct {
+	Prompt         string `json:"prompt"`
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	Width          int    `json:"width,omitempty"`
+	Height         int    `json:"height,omitempty"`
+	Steps          int    `json:"steps,omitempty"`
+	NumSteps       int    `json:"num_steps,omitempty"`
+	Seed           int64  `json:"seed,omitempty"`
+	ImageB64       string `json:"image_b64,omitempty"`
+	Mask           []int  `json:"mask,omitempty"`
+}
+
+var errImageInputUnsupported = errors.New("model does not support image input")
+
 func HandlerImage(w http.ResponseWriter, req *http.Request) {
 	var (
 		requestBody RequestGenerateImage
@@ -44,38 +101,44 @@ func HandlerImage(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	prompt := cmp.Or(requestBody.Prompt, requestBody.Inputs)
+	params := ImageParams{
+		Prompt:         cmp.Or(requestBody.Prompt, requestBody.Inputs),
+		NegativePrompt: requestBody.NegativePrompt,
+		Width:          requestBody.Width,
+		Height:         requestBody.Height,
+		Steps:          requestBody.Steps,
+		Seed:           requestBody.Seed,
+	}
 
-	if len(prompt) == 0 {
+	if len(params.Prompt) == 0 {
 		http.Error(w, "Empty prompt", http.StatusBadRequest)
 
 		return
 	}
 
-	if requestBody.Model == "" || requestBody.Model == "all" {
-		for _, model := range Models {
-			if model.MaxRequestLength != 0 {
-				continue
-			}
+	if requestBody.ResponseFormat != "" {
+		err = checkImageResponseFormat(requestBody.ResponseFormat)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 
-			if RateLimits[model.Name].minuteCount >= model.RequestsPerMin ||
-				RateLimits[model.Name].hourCount >= model.RequestsPerHour ||
-				RateLimits[model.Name].dayCount >= model.RequestsPerDay {
-				continue
-			}
-
-			response, err = RequestProvider(model.Name, prompt)
-			if err != nil {
-				setMaxLimitMinute(model.Name) // set max minuteCount for pause after error
-				log.Printf("ERROR: %s, body: %s\n", err, string(response))
+			return
+		}
+	}
 
-				continue
-			}
+	if requestBody.Size != "" {
+		params.Width, params.Height, err = parseImageSize(requestBody.Size)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 
-			break
+			return
 		}
-	} else {
-		response, err = RequestProvider(requestBody.Model, prompt)
+	}
+
+	response, err = generateImage(req.Context(), requestBody.Model, params)
+	if errors.Is(err, errNoModels) {
+		http.Error(w, "No available image models", http.StatusServiceUnavailable)
+
+		return
 	}
 
 	if err != nil {
@@ -87,36 +150,127 @@ func HandlerImage(w http.ResponseWriter, req *http.Request) {
 
 	log.Printf("Get image in %d bytes\n", len(response))
 
-	w.Header().Set("Content-Type", "image/jpeg")
+	if requestBody.ResponseFormat != "" {
+		writeImageResponse(w, req, response, requestBody.ResponseFormat)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(response))
 	w.Write(response)
 }
 
-func RequestProvider(modelName, prompt string) ([]byte, error) {
-	model, found := getModelByName(modelName)
-	if !found {
+// generateImage calls the named model, or the image pool when modelName is empty or "all".
+func generateImage(ctx context.Context, modelName string, params ImageParams) ([]byte, error) {
+	if modelName != "" && modelName != "all" {
+		return RequestProvider(ctx, modelName, params)
+	}
+
+	return callWithFailover(func(model Model) bool {
+		return model.Type == ModelTypeImage && (params.Image == nil || supportsImageInput(model, params))
+	}, func(modelName string) ([]byte, error) {
+		return RequestProvider(ctx, modelName, params)
+	})
+}
+
+// supportsImageInput reports whether the provider can take a source image (and mask) as input.
+func supportsImageInput(model Model, params ImageParams) bool {
+	switch model.Provider {
+	case "huggingface", "together", "aimlapi":
+		return params.Mask == nil
+	case "cloudflare":
+		return !isFluxModel(model)
+	default:
+		return false
+	}
+}
+
+func isFluxModel(model Model) bool {
+	return strings.Contains(strings.ToLower(model.Name), "flux")
+}
+
+func parseImageSize(size string) (int, int, error) {
+	var width, height int
+
+	_, err := fmt.Sscanf(size, "%dx%d", &width, &height)
+	if err != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid image size %q, expected WIDTHxHEIGHT", size)
+	}
+
+	return width, height, nil
+}
+
+func RequestProvider(ctx context.Context, modelName string, params ImageParams) ([]byte, error) {
+	model, found := findModel(modelName)
+	if !found || model.Disabled {
 		return nil, fmt.Errorf("Specified model not found - %s", modelName)
 	}
 
-	log.Printf("Request to image model: %s - %s\n", modelName, printFirstChars(prompt))
+	// checked before the request is counted against the model limits
+	if params.Image != nil && !supportsImageInput(model, params) {
+		return nil, fmt.Errorf("%w: %s", errImageInputUnsupported, modelName)
+	}
+
+	model = pickToken(model)
+
+	release, err := acquireModel(ctx, model)
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	ctx, cancel := modelContext(ctx, model)
+	defer cancel()
+
+	log.Printf("Request to image model: %s - %s\n", modelName, printFirstChars(params.Prompt))
 
 	if model.Provider == "airforce" {
-		return getAairforceImagine(model.URL, prompt, strings.TrimPrefix(model.Name, model.Provider+"/"))
+		return getAairforceImagine(ctx, model.URL, params.Prompt, strings.TrimPrefix(model.Name, model.Provider+"/"))
 	}
 
-	data, err := generatePayload(model, prompt)
+	data, err := generatePayload(model, params)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, model.URL, bytes.NewBuffer(data))
+	body, err := callWithToken(model, func(token string) ([]byte, error) {
+		return postImageRequest(ctx, model.URL, token, data)
+	})
+	if err != nil {
+		return body, err
+	}
+
+	if len(body) < 500 {
+		return body, fmt.Errorf("small response length: %d", len(body))
+	}
+
+	switch model.Provider {
+	case "cloudflare":
+		// FLUX models answer with JSON, Stable Diffusion ones with the raw image
+		if image := gjson.GetBytes(body, "result.image"); image.Exists() {
+			return base64.StdEncoding.DecodeString(image.String())
+		}
+
+		return body, nil
+	case "together", "aimlapi":
+		return base64.StdEncoding.DecodeString(gjson.GetBytes(body, "data.0.b64_json").String())
+
+	default:
+		return body, nil
+	}
+}
+
+func postImageRequest(ctx context.Context, providerURL, token string, data []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, providerURL, bytes.NewBuffer(data))
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", model.Token))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpclient.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -129,52 +283,90 @@ func RequestProvider(modelName, prompt string) ([]byte, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return body, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-	}
-
-	if len(body) < 500 {
-		return body, fmt.Errorf("small response length: %d", len(body))
+		return body, &httpclient.StatusError{Code: resp.StatusCode}
 	}
 
-	switch model.Name {
-	case "cloudflare/black-forest-labs/flux-1-schnell":
-		return base64.StdEncoding.DecodeString(gjson.GetBytes(body, "result.image").String())
-	case "together/black-forest-labs/FLUX.1-schnell-Free", "aimlapi/flux/schnell":
-		return base64.StdEncoding.DecodeString(gjson.GetBytes(body, "data.0.b64_json").String())
-
-	default:
-		return body, nil
-	}
+	return body, nil
 }
 
-func generatePayload(model Model, prompt string) ([]byte, error) {
+func generatePayload(model Model, params ImageParams) ([]byte, error) {
 	var data []byte
 
 	var err error
 
 	switch model.Provider {
 	case "huggingface":
-		var payload RequestGenerateImage
+		var payload HuggingFaceRequestGenerateImage
+
+		parameters := HuggingFaceParameters{
+			NegativePrompt:    params.NegativePrompt,
+			Width:             params.Width,
+			Height:            params.Height,
+			NumInferenceSteps: params.Steps,
+			Seed:              params.Seed,
+		}
+
+		// image-to-image takes the source image as inputs and the prompt as a parameter
+		if params.Image != nil {
+			payload.Inputs = base64.StdEncoding.EncodeToString(params.Image)
+			parameters.Prompt = params.Prompt
+		} else {
+			payload.Inputs = params.Prompt
+		}
 
-		payload.Inputs = prompt
+		if parameters != (HuggingFaceParameters{}) {
+			payload.Parameters = &parameters
+		}
 
 		data, err = json.Marshal(payload)
 
-	// case "cloudflare":
+	case "cloudflare":
+		var payload CloudflareRequestGenerateImage
+
+		payload.Prompt = params.Prompt
+		payload.Seed = params.Seed
+
+		if isFluxModel(model) {
+			payload.Steps = params.Steps
+		} else {
+			payload.NegativePrompt = params.NegativePrompt
+			payload.Width = params.Width
+			payload.Height = params.Height
+			payload.NumSteps = params.Steps
+
+			if params.Image != nil {
+				payload.ImageB64 = base64.StdEncoding.EncodeToString(params.Image)
+			}
+
+			for _, b := range params.Mask {
+				payload.Mask = append(payload.Mask, int(b))
+			}
+		}
+
+		data, err = json.Marshal(payload)
 
 	case "together", "aimlapi":
 		var payload TogetherRequestGenerateImage
 
 		payload.Model = strings.TrimPrefix(model.Name, model.Provider+"/")
-		payload.Prompt = prompt
+		payload.Prompt = params.Prompt
 		payload.ResponseFormat = "b64_json"
+		payload.NegativePrompt = params.NegativePrompt
+		payload.Width = params.Width
+		payload.Height = params.Height
+		payload.Steps = params.Steps
+		payload.Seed = params.Seed
+
+		if params.Image != nil {
+			payload.ImageURL = "data:" + http.DetectContentType(params.Image) + ";base64," + base64.StdEncoding.EncodeToString(params.Image)
+		}
 
 		data, err = json.Marshal(payload)
 
 	default:
 		var payload RequestGenerateImage
 
-		payload.Prompt = prompt
+		payload.Prompt = params.Prompt
 
 		data, err = json.Marshal(payload)
 	}
@@ -182,7 +374,7 @@ func generatePayload(model Model, prompt string) ([]byte, error) {
 	return data, err
 }
 
-func getAairforceImagine(baseURL, prompt, model string) ([]byte, error) {
+func getAairforceImagine(ctx context.Context, baseURL, prompt, model string) ([]byte, error) {
 	// Формируем URL с параметрами
 	params := url.Values{}
 	params.Add("prompt", prompt)
@@ -191,8 +383,13 @@ func getAairforceImagine(baseURL, prompt, model string) ([]byte, error) {
 	// Создаем полный URL
 	fullURL := fmt.Sprintf("%s?%s", baseURL, params.Encode())
 
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fullURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	// Выполняем GET запрос
-	resp, err := http.Get(fullURL)
+	resp, err := httpclient.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -204,7 +401,7 @@ func getAairforceImagine(baseURL, prompt, model string) ([]byte, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return body, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return body, &httpclient.StatusError{Code: resp.StatusCode}
 	}
 
 	if len(body) < 500 {
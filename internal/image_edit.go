@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Пример запроса
+// curl http://127.0.0.1:8080/images/edits -F image=@cat.png -F mask=@mask.png -F prompt="Cat in a space suit"
+
+const (
+	maxImageUploadSize = 32 << 20
+	variationPrompt    = "A variation of this image"
+)
+
+type ResponseImage struct {
+	Created int64               `json:"created"`
+	Data    []ResponseImageData `json:"data"`
+}
+
+type ResponseImageData struct {
+	URL     string `json:"url,omitempty"`
+	B64JSON string `json:"b64_json,omitempty"`
+}
+
+// HandlerImageEdit implements the OpenAI compatible /images/edits endpoint
+// (image-to-image, and inpainting when a mask is uploaded).
+func HandlerImageEdit(w http.ResponseWriter, req *http.Request) {
+	handleImageUpload(w, req, true)
+}
+
+// HandlerImageVariation implements the OpenAI compatible /images/variations endpoint.
+func HandlerImageVariation(w http.ResponseWriter, req *http.Request) {
+	handleImageUpload(w, req, false)
+}
+
+func handleImageUpload(w http.ResponseWriter, req *http.Request, edit bool) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, maxImageUploadSize)
+
+	err := req.ParseMultipartForm(maxImageUploadSize)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Upload is larger than %d bytes", maxImageUploadSize), http.StatusRequestEntityTooLarge)
+
+			return
+		}
+
+		http.Error(w, "Invalid multipart form", http.StatusBadRequest)
+
+		return
+	}
+
+	params, err := parseImageForm(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if edit {
+		params.Mask, err = readFormFile(req, "mask")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		if params.Prompt == "" {
+			http.Error(w, "Empty prompt", http.StatusBadRequest)
+
+			return
+		}
+	} else {
+		params.Prompt = cmp.Or(params.Prompt, variationPrompt)
+	}
+
+	format := req.FormValue("response_format")
+	if format == "" {
+		format = "b64_json"
+		if Files != nil {
+			format = "url"
+		}
+	}
+
+	err = checkImageResponseFormat(format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	response, err := generateImage(req.Context(), req.FormValue("model"), params)
+	if errors.Is(err, errNoModels) {
+		http.Error(w, "No available image models for this request", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	if err != nil {
+		log.Printf("ERROR: %s, body: %s\n", err, string(response))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	log.Printf("Get image in %d bytes\n", len(response))
+
+	writeImageResponse(w, req, response, format)
+}
+
+func checkImageResponseFormat(format string) error {
+	switch format {
+	case "b64_json":
+		return nil
+	case "url":
+		if Files == nil {
+			return errors.New("response_format url requires image_storage to be configured")
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unsupported response_format %q", format)
+	}
+}
+
+// writeImageResponse answers in the OpenAI images format, storing the image when a URL is requested.
+func writeImageResponse(w http.ResponseWriter, req *http.Request, image []byte, format string) {
+	var data ResponseImageData
+
+	if format == "url" {
+		id, err := saveFile(image)
+		if err != nil {
+			log.Printf("Error saving image: %v", err)
+			http.Error(w, "Error saving image", http.StatusInternalServerError)
+
+			return
+		}
+
+		data.URL = fileURL(req, id)
+	} else {
+		data.B64JSON = base64.StdEncoding.EncodeToString(image)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ResponseImage{
+		Created: time.Now().Unix(),
+		Data:    []ResponseImageData{data},
+	})
+}
+
+func parseImageForm(req *http.Request) (ImageParams, error) {
+	var (
+		params ImageParams
+		err    error
+	)
+
+	params.Image, err = readFormFile(req, "image", "image[]")
+	if err != nil {
+		return params, err
+	}
+
+	if params.Image == nil {
+		return params, errors.New("image file is required")
+	}
+
+	params.Prompt = req.FormValue("prompt")
+	params.NegativePrompt = req.FormValue("negative_prompt")
+
+	if size := req.FormValue("size"); size != "" {
+		params.Width, params.Height, err = parseImageSize(size)
+		if err != nil {
+			return params, err
+		}
+	}
+
+	for name, value := range map[string]*int{"width": &params.Width, "height": &params.Height, "steps": &params.Steps} {
+		if v := req.FormValue(name); v != "" {
+			*value, err = strconv.Atoi(v)
+			if err != nil {
+				return params, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+
+	if v := req.FormValue("seed"); v != "" {
+		params.Seed, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return params, fmt.Errorf("invalid seed: %w", err)
+		}
+	}
+
+	return params, nil
+}
+
+// readFormFile returns the content of the first uploaded file found under
+// one of the names, or nil when none was sent.
+func readFormFile(req *http.Request, names ...string) ([]byte, error) {
+	for _, name := range names {
+		file, _, err := req.FormFile(name)
+		if errors.Is(err, http.ErrMissingFile) {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", name, err)
+		}
+
+		defer file.Close()
+
+		return io.ReadAll(file)
+	}
+
+	return nil, nil
+}
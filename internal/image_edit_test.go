@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlerImageEditTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+
+	form := multipart.NewWriter(&buf)
+
+	part, err := form.CreateFormFile("image", "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	part.Write(make([]byte, maxImageUploadSize+1))
+	form.WriteField("prompt", "a cat")
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/images/edits", &buf)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	w := httptest.NewRecorder()
+	HandlerImageEdit(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,424 @@
+// Package jsonschema validates decoded JSON values against the subset of JSON Schema
+// used by OpenAI structured outputs: types, properties, required, additionalProperties,
+// items, enum, const, numeric and length bounds, pattern, anyOf/oneOf/allOf and local $ref.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+
+	return e.Path + ": " + e.Message
+}
+
+// maxSteps limits the schemas checked for one value, as nested anyOf and $ref
+// may multiply the work exponentially.
+const maxSteps = 100000
+
+type validator struct {
+	root   map[string]any
+	active map[string]bool // $refs being followed, by ref and path; seen again they form a cycle
+	steps  int
+}
+
+// Validate checks value (as produced by json.Unmarshal into any) against schema.
+func Validate(schema, value any) error {
+	root, _ := schema.(map[string]any)
+
+	v := &validator{root: root, active: make(map[string]bool)}
+
+	err := v.validate(schema, value, "")
+	if v.steps > maxSteps {
+		// combinators may have turned the aborted checks into any result
+		return &ValidationError{Message: "schema is too complex to validate"}
+	}
+
+	return err
+}
+
+// ValidateJSON parses data and validates it against schema.
+func ValidateJSON(schema any, data []byte) error {
+	var value any
+
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return &ValidationError{Message: "invalid JSON: " + err.Error()}
+	}
+
+	return Validate(schema, value)
+}
+
+func (v *validator) validate(schemaValue, value any, path string) error {
+	v.steps++
+	if v.steps > maxSteps {
+		return &ValidationError{Path: path, Message: "schema is too complex to validate"}
+	}
+
+	// true accepts anything, false rejects everything
+	if b, ok := schemaValue.(bool); ok {
+		if !b {
+			return &ValidationError{Path: path, Message: "value is not allowed"}
+		}
+
+		return nil
+	}
+
+	schema, ok := schemaValue.(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		// a $ref reached again for the same value never reaches the data
+		key := ref + "\x00" + path
+		if v.active[key] {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("cyclic $ref %q", ref)}
+		}
+
+		resolved, err := v.resolve(ref)
+		if err != nil {
+			return &ValidationError{Path: path, Message: err.Error()}
+		}
+
+		v.active[key] = true
+		defer delete(v.active, key)
+
+		return v.validate(resolved, value, path)
+	}
+
+	err := v.validateType(schema, value, path)
+	if err != nil {
+		return err
+	}
+
+	if enum, ok := schema["enum"].([]any); ok && !containsValue(enum, value) {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("value %s is not one of %s", dump(value), dump(enum))}
+	}
+
+	if constValue, ok := schema["const"]; ok && !equal(constValue, value) {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("value must be %s", dump(constValue))}
+	}
+
+	err = v.validateCombinators(schema, value, path)
+	if err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case map[string]any:
+		return v.validateObject(schema, value, path)
+	case []any:
+		return v.validateArray(schema, value, path)
+	case string:
+		return validateString(schema, value, path)
+	case float64:
+		return validateNumber(schema, value, path)
+	}
+
+	return nil
+}
+
+func (v *validator) resolve(ref string) (any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+
+	var node any = v.root
+
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+
+		node, ok = m[part]
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+
+	return node, nil
+}
+
+func (v *validator) validateType(schema map[string]any, value any, path string) error {
+	var types []string
+
+	switch t := schema["type"].(type) {
+	case string:
+		types = []string{t}
+	case []any:
+		for _, v := range t {
+			if s, ok := v.(string); ok {
+				types = append(types, s)
+			}
+		}
+	default:
+		return nil
+	}
+
+	actual := typeOf(value)
+
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return nil
+		}
+	}
+
+	return &ValidationError{Path: path, Message: fmt.Sprintf("expected %s, got %s", strings.Join(types, " or "), actual)}
+}
+
+func (v *validator) validateCombinators(schema map[string]any, value any, path string) error {
+	if allOf, ok := schema["allOf"].([]any); ok {
+		for _, sub := range allOf {
+			err := v.validate(sub, value, path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		var firstErr error
+
+		for _, sub := range anyOf {
+			err := v.validate(sub, value, path)
+			if err == nil {
+				firstErr = nil
+
+				break
+			}
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		if firstErr != nil {
+			return &ValidationError{Path: path, Message: "value does not match any of anyOf: " + firstErr.Error()}
+		}
+	}
+
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		var matched int
+
+		for _, sub := range oneOf {
+			if v.validate(sub, value, path) == nil {
+				matched++
+			}
+		}
+
+		if matched != 1 {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("value matches %d schemas of oneOf, expected exactly 1", matched)}
+		}
+	}
+
+	if not, ok := schema["not"]; ok && v.validate(not, value, path) == nil {
+		return &ValidationError{Path: path, Message: "value must not match the not schema"}
+	}
+
+	return nil
+}
+
+func (v *validator) validateObject(schema map[string]any, value map[string]any, path string) error {
+	properties, _ := schema["properties"].(map[string]any)
+
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			if s, ok := name.(string); ok {
+				if _, ok := value[s]; !ok {
+					return &ValidationError{Path: path, Message: fmt.Sprintf("missing required property %q", s)}
+				}
+			}
+		}
+	}
+
+	for name, propertyValue := range value {
+		propertyPath := path + "." + name
+
+		if propertySchema, ok := properties[name]; ok {
+			err := v.validate(propertySchema, propertyValue, propertyPath)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		additional, ok := schema["additionalProperties"]
+		if !ok {
+			continue
+		}
+
+		if b, ok := additional.(bool); ok && !b {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("unexpected property %q", name)}
+		}
+
+		err := v.validate(additional, propertyValue, propertyPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if n, ok := number(schema["minProperties"]); ok && float64(len(value)) < n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("expected at least %v properties", n)}
+	}
+
+	if n, ok := number(schema["maxProperties"]); ok && float64(len(value)) > n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("expected at most %v properties", n)}
+	}
+
+	return nil
+}
+
+func (v *validator) validateArray(schema map[string]any, value []any, path string) error {
+	if n, ok := number(schema["minItems"]); ok && float64(len(value)) < n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("expected at least %v items", n)}
+	}
+
+	if n, ok := number(schema["maxItems"]); ok && float64(len(value)) > n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("expected at most %v items", n)}
+	}
+
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range value {
+			for j := i + 1; j < len(value); j++ {
+				if equal(value[i], value[j]) {
+					return &ValidationError{Path: path, Message: fmt.Sprintf("items %d and %d are equal", i, j)}
+				}
+			}
+		}
+	}
+
+	items, ok := schema["items"]
+	if !ok {
+		return nil
+	}
+
+	for i, item := range value {
+		err := v.validate(items, item, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateString(schema map[string]any, value, path string) error {
+	length := float64(utf8.RuneCountInString(value))
+
+	if n, ok := number(schema["minLength"]); ok && length < n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("expected at least %v characters", n)}
+	}
+
+	if n, ok := number(schema["maxLength"]); ok && length > n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("expected at most %v characters", n)}
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err == nil && !re.MatchString(value) {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("value does not match pattern %q", pattern)}
+		}
+	}
+
+	return nil
+}
+
+func validateNumber(schema map[string]any, value float64, path string) error {
+	if n, ok := number(schema["minimum"]); ok && value < n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("value must be >= %v", n)}
+	}
+
+	if n, ok := number(schema["maximum"]); ok && value > n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("value must be <= %v", n)}
+	}
+
+	if n, ok := number(schema["exclusiveMinimum"]); ok && value <= n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("value must be > %v", n)}
+	}
+
+	if n, ok := number(schema["exclusiveMaximum"]); ok && value >= n {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("value must be < %v", n)}
+	}
+
+	if n, ok := number(schema["multipleOf"]); ok && n > 0 {
+		if q := value / n; math.Abs(q-math.Round(q)) > 1e-9 {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("value must be a multiple of %v", n)}
+		}
+	}
+
+	return nil
+}
+
+func typeOf(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func number(value any) (float64, bool) {
+	n, ok := value.(float64)
+
+	return n, ok
+}
+
+func containsValue(values []any, value any) bool {
+	for _, v := range values {
+		if equal(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func equal(a, b any) bool {
+	return dump(a) == dump(b)
+}
+
+func dump(value any) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+
+	return string(data)
+}
@@ -0,0 +1,110 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		data    string
+		wantErr string // substring of the error, "" when valid
+	}{
+		{"type string", `{"type":"string"}`, `"a"`, ""},
+		{"type mismatch", `{"type":"string"}`, `1`, "expected string, got integer"},
+		{"integer is a number", `{"type":"number"}`, `3`, ""},
+		{"number is not an integer", `{"type":"integer"}`, `3.5`, "expected integer, got number"},
+		{"type list", `{"type":["string","null"]}`, `null`, ""},
+		{"invalid JSON", `{"type":"object"}`, `{"a":`, "invalid JSON"},
+		{"required", `{"type":"object","required":["a"]}`, `{"b":1}`, `missing required property "a"`},
+		{"property", `{"properties":{"a":{"type":"integer"}}}`, `{"a":"x"}`, ".a: expected integer"},
+		{"no additional properties", `{"properties":{"a":{}},"additionalProperties":false}`, `{"a":1,"b":2}`, `unexpected property "b"`},
+		{"additional properties schema", `{"additionalProperties":{"type":"string"}}`, `{"a":1}`, ".a: expected string"},
+		{"items", `{"type":"array","items":{"type":"integer"}}`, `[1,"2"]`, "[1]: expected integer"},
+		{"min items", `{"minItems":2}`, `[1]`, "at least 2 items"},
+		{"unique items", `{"uniqueItems":true}`, `[1,2,1]`, "items 0 and 2 are equal"},
+		{"enum", `{"enum":["a","b"]}`, `"c"`, "is not one of"},
+		{"const", `{"const":{"a":1}}`, `{"a":1}`, ""},
+		{"string length", `{"maxLength":2}`, `"äöü"`, "at most 2 characters"},
+		{"pattern", `{"pattern":"^[a-z]+$"}`, `"A1"`, "does not match pattern"},
+		{"minimum", `{"minimum":1}`, `0`, "value must be >= 1"},
+		{"exclusive maximum", `{"exclusiveMaximum":1}`, `1`, "value must be < 1"},
+		{"multiple of", `{"multipleOf":0.1}`, `0.3`, ""},
+		{"any of", `{"anyOf":[{"type":"string"},{"type":"integer"}]}`, `true`, "does not match any of anyOf"},
+		{"one of", `{"oneOf":[{"type":"number"},{"type":"integer"}]}`, `1`, "matches 2 schemas of oneOf"},
+		{"all of", `{"allOf":[{"type":"object"},{"required":["a"]}]}`, `{}`, `missing required property "a"`},
+		{"not", `{"not":{"type":"null"}}`, `null`, "must not match"},
+		{"false schema", `{"properties":{"a":false}}`, `{"a":1}`, "value is not allowed"},
+		{"ref to defs", `{"$defs":{"n":{"type":"integer"}},"items":{"$ref":"#/$defs/n"}}`, `[1,"x"]`, "[1]: expected integer"},
+		{"unresolvable ref", `{"$ref":"#/$defs/missing"}`, `1`, "unresolvable $ref"},
+		{"remote ref", `{"$ref":"https://example.com/schema.json"}`, `1`, "unsupported $ref"},
+		{
+			"recursive ref over the data",
+			`{"type":"object","properties":{"children":{"type":"array","items":{"$ref":"#"}}}}`,
+			`{"children":[{"children":[{"children":[]}]}]}`,
+			"",
+		},
+		{
+			"recursive ref with an invalid leaf",
+			`{"type":"object","properties":{"children":{"type":"array","items":{"$ref":"#"}}}}`,
+			`{"children":[{"children":[1]}]}`,
+			".children[0].children[0]: expected object",
+		},
+		{"self ref", `{"$ref":"#"}`, `{}`, "cyclic $ref"},
+		{"mutual refs", `{"$defs":{"a":{"$ref":"#/$defs/b"},"b":{"$ref":"#/$defs/a"}},"$ref":"#/$defs/a"}`, `1`, "cyclic $ref"},
+		{"cyclic ref in anyOf", `{"anyOf":[{"$ref":"#"},{"$ref":"#"}]}`, `1`, "does not match any of anyOf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var schema any
+
+			err := json.Unmarshal([]byte(tt.schema), &schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = ValidateJSON(schema, []byte(tt.data))
+
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("expected error containing %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("error %q does not contain %q", err, tt.wantErr)
+			}
+
+			var validationErr *ValidationError
+			if err != nil && !errors.As(err, &validationErr) {
+				t.Errorf("error %v is not a *ValidationError", err)
+			}
+		})
+	}
+}
+
+func TestValidateJSONTooComplex(t *testing.T) {
+	// every level doubles the work without a cycle
+	defs := map[string]any{"d0": map[string]any{"type": "integer"}}
+	for i := 1; i <= 40; i++ {
+		ref := map[string]any{"$ref": "#/$defs/d" + itoa(i-1)}
+		defs["d"+itoa(i)] = map[string]any{"anyOf": []any{map[string]any{"type": "string"}, ref, ref}}
+	}
+
+	schema := map[string]any{"$defs": defs, "$ref": "#/$defs/d40"}
+
+	err := ValidateJSON(schema, []byte(`true`))
+	if err == nil || !strings.Contains(err.Error(), "too complex") {
+		t.Fatalf("expected a too complex error, got %v", err)
+	}
+}
+
+func itoa(i int) string {
+	data, _ := json.Marshal(i)
+
+	return string(data)
+}
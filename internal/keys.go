@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"ai-proxy/internal/httpclient"
+)
+
+// How a model with several tokens spreads its requests over them.
+const (
+	TokenLeastUsed  = "least_used"  // the token with the fewest requests this minute (default)
+	TokenRoundRobin = "round_robin" // the tokens in turn
+)
+
+// rejectedTokenPause is how long a token refused with 401 or 403 is skipped.
+const rejectedTokenPause = time.Hour
+
+var (
+	roundRobin = make(map[string]int)
+	pickMu     sync.Mutex
+
+	providerRateLimits   = make(map[string]*RateLimit) // requests of all models of a provider
+	providerRateLimitsMu sync.Mutex
+)
+
+func IsTokenSelection(selection string) bool {
+	return selection == TokenLeastUsed || selection == TokenRoundRobin
+}
+
+// NewRateLimits returns the rate limits of a model, one per token.
+func NewRateLimits(model Model) []*RateLimit {
+	limits := make([]*RateLimit, max(len(model.Tokens), 1))
+
+	for i := range limits {
+		limits[i] = &RateLimit{}
+	}
+
+	return limits
+}
+
+// hasQuota reports whether the token may take a request under the model limits; the lock must be held.
+func (limit *RateLimit) hasQuota(model Model, now time.Time) bool {
+	updateLimitCounters(limit, now)
+
+	return !now.Before(limit.blockedUntil) &&
+		limit.minuteCount < model.RequestsPerMin &&
+		limit.hourCount < model.RequestsPerHour &&
+		limit.dayCount < model.RequestsPerDay
+}
+
+// providerRateLimit returns the counters shared by the models of a provider
+// whose providers block sets requests limits, nil for other providers.
+func providerRateLimit(model Model) (*RateLimit, ProviderConfig) {
+	provider, ok := Providers[model.Provider]
+	if !ok || provider.RequestsPerMin == 0 && provider.RequestsPerHour == 0 && provider.RequestsPerDay == 0 {
+		return nil, provider
+	}
+
+	providerRateLimitsMu.Lock()
+	defer providerRateLimitsMu.Unlock()
+
+	if providerRateLimits[model.Provider] == nil {
+		providerRateLimits[model.Provider] = &RateLimit{}
+	}
+
+	return providerRateLimits[model.Provider], provider
+}
+
+// providerHasQuota reports whether the provider of the model may take another
+// request; a provider limit of 0 leaves that window unlimited.
+func providerHasQuota(model Model, now time.Time) bool {
+	limit, provider := providerRateLimit(model)
+	if limit == nil {
+		return true
+	}
+
+	limit.mux.Lock()
+	defer limit.mux.Unlock()
+
+	updateLimitCounters(limit, now)
+
+	return (provider.RequestsPerMin == 0 || limit.minuteCount < provider.RequestsPerMin) &&
+		(provider.RequestsPerHour == 0 || limit.hourCount < provider.RequestsPerHour) &&
+		(provider.RequestsPerDay == 0 || limit.dayCount < provider.RequestsPerDay)
+}
+
+// countRequest counts a request against the token limit and the provider limit of the model.
+func countRequest(model Model, limit *RateLimit, now time.Time) {
+	limits := []*RateLimit{limit}
+
+	if shared, _ := providerRateLimit(model); shared != nil {
+		limits = append(limits, shared)
+	}
+
+	for _, limit := range limits {
+		limit.mux.Lock()
+		updateLimitCounters(limit, now)
+		limit.minuteCount++
+		limit.hourCount++
+		limit.dayCount++
+		limit.lastRequest = now
+		limit.mux.Unlock()
+	}
+}
+
+// tokenWithQuota reports whether a token of the model has quota left and
+// returns the earliest last request among such tokens.
+func tokenWithQuota(model Model, now time.Time) (time.Time, bool) {
+	var (
+		lastRequest time.Time
+		found       bool
+	)
+
+	if !providerHasQuota(model, now) {
+		return lastRequest, false
+	}
+
+	for _, limit := range modelRateLimits(model.Name) {
+		limit.mux.Lock()
+
+		if limit.hasQuota(model, now) && (!found || limit.lastRequest.Before(lastRequest)) {
+			lastRequest = limit.lastRequest
+			found = true
+		}
+
+		limit.mux.Unlock()
+	}
+
+	return lastRequest, found
+}
+
+// pickToken returns the model with Token set to the token chosen for the next
+// request and counts the request against it. Without quota left on any token the
+// least used one is taken, as requests naming the model bypass the limits.
+func pickToken(model Model) Model {
+	model, _ = pickTokenWithQuota(model, false)
+
+	return model
+}
+
+func pickTokenWithQuota(model Model, needQuota bool) (Model, bool) {
+	pickMu.Lock()
+	defer pickMu.Unlock()
+
+	limits := modelRateLimits(model.Name)
+	if len(limits) == 0 {
+		return model, false // removed meanwhile
+	}
+
+	now := time.Now()
+	start := 0
+
+	if model.TokenSelection == TokenRoundRobin {
+		start = roundRobin[model.Name]
+	}
+
+	best, bestQuota := -1, false
+
+	for n := range limits {
+		i := (start + n) % len(limits)
+
+		limit := limits[i]
+		limit.mux.Lock()
+		quota := limit.hasQuota(model, now)
+		limit.mux.Unlock()
+
+		switch {
+		case best < 0 || quota && !bestQuota:
+			best, bestQuota = i, quota
+		case quota == bestQuota && model.TokenSelection != TokenRoundRobin && lessUsed(limit, limits[best]):
+			best = i
+		}
+	}
+
+	if needQuota && (!bestQuota || !providerHasQuota(model, now)) {
+		return model, false
+	}
+
+	roundRobin[model.Name] = best + 1
+
+	countRequest(model, limits[best], now)
+
+	if len(model.Tokens) > 0 {
+		model.Token = model.Tokens[best]
+	}
+
+	return model, true
+}
+
+func lessUsed(a, b *RateLimit) bool {
+	a.mux.Lock()
+	aCount, aLast := a.minuteCount, a.lastRequest
+	a.mux.Unlock()
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return aCount < b.minuteCount || aCount == b.minuteCount && aLast.Before(b.lastRequest)
+}
+
+// callWithToken calls the provider with the token of the model, moving on to
+// the other tokens of the model while the provider refuses them.
+func callWithToken[T any](model Model, call func(token string) (T, error)) (T, error) {
+	for {
+		res, err := call(model.Token)
+
+		next, ok := retryToken(model, err)
+		if !ok {
+			return res, err
+		}
+
+		model = next
+	}
+}
+
+// retryToken blocks the token of a model with several tokens when the provider
+// refused it and returns the model with another token that has quota left.
+func retryToken(model Model, err error) (Model, bool) {
+	code := httpclient.StatusCode(err)
+	if len(model.Tokens) < 2 ||
+		code != http.StatusUnauthorized && code != http.StatusForbidden && code != http.StatusTooManyRequests {
+		return model, false
+	}
+
+	limits := modelRateLimits(model.Name)
+
+	i := slices.Index(model.Tokens, model.Token)
+	if i < 0 || i >= len(limits) {
+		return model, false
+	}
+
+	limit := limits[i]
+	limit.mux.Lock()
+
+	if code == http.StatusTooManyRequests {
+		// the provider counts differently, skip the token until its minute is over
+		limit.blockedUntil = limit.lastMinute.Add(time.Minute)
+	} else {
+		limit.blockedUntil = time.Now().Add(rejectedTokenPause)
+	}
+
+	log.Printf("Token %d of %s refused with %d, skipped until %s", i+1, model.Name, code, limit.blockedUntil.Format(time.TimeOnly))
+	limit.mux.Unlock()
+
+	return pickTokenWithQuota(model, true)
+}
@@ -0,0 +1,151 @@
+// Package limiter limits the number of concurrent requests to a provider or a
+// model and spaces their starts, keeping statistics of the time spent waiting.
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	MaxConcurrency int           `yaml:"max_concurrency"` // 0 is unlimited
+	MinInterval    time.Duration `yaml:"min_interval"`    // after the end of a request and between starts
+}
+
+type Stats struct {
+	Requests int64         // requests that got through
+	Waiting  int           // requests waiting now
+	InFlight int           // requests running now
+	WaitTime time.Duration // total time spent waiting
+	MaxWait  time.Duration
+}
+
+type Limiter struct {
+	cfg  Config
+	sem  chan struct{} // nil when the concurrency is unlimited
+	mu   sync.Mutex
+	next time.Time // earliest start of the next request
+
+	stats Stats
+}
+
+func New(cfg Config) *Limiter {
+	l := &Limiter{cfg: cfg}
+
+	if cfg.MaxConcurrency > 0 {
+		l.sem = make(chan struct{}, cfg.MaxConcurrency)
+	}
+
+	return l
+}
+
+// Acquire waits for a free slot and MinInterval after the end of the previous
+// request; requests running at the same time start at least MinInterval apart.
+// It returns the time spent waiting and release, which must be called when the request is done.
+func (l *Limiter) Acquire(ctx context.Context) (time.Duration, func(), error) {
+	start := time.Now()
+
+	l.mu.Lock()
+	l.stats.Waiting++
+	l.mu.Unlock()
+
+	err := l.wait(ctx)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stats.Waiting--
+
+	if err != nil {
+		return time.Since(start), nil, err
+	}
+
+	wait := time.Since(start)
+
+	l.stats.Requests++
+	l.stats.InFlight++
+	l.stats.WaitTime += wait
+	l.stats.MaxWait = max(l.stats.MaxWait, wait)
+
+	var once sync.Once
+
+	return wait, func() {
+		once.Do(l.release)
+	}, nil
+}
+
+func (l *Limiter) wait(ctx context.Context) error {
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if l.cfg.MinInterval <= 0 {
+		return nil
+	}
+
+	// reserve the next start, so that concurrent requests are spaced too
+	l.mu.Lock()
+	now := time.Now()
+
+	at := now
+	if l.next.After(now) {
+		at = l.next
+	}
+
+	l.next = at.Add(l.cfg.MinInterval)
+	l.mu.Unlock()
+
+	if !at.After(now) {
+		return nil
+	}
+
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		if l.sem != nil {
+			<-l.sem
+		}
+
+		// give the start back unless a later request has reserved the one after it
+		l.mu.Lock()
+		if l.next.Equal(at.Add(l.cfg.MinInterval)) {
+			l.next = at
+		}
+		l.mu.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+func (l *Limiter) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+
+	l.mu.Lock()
+	l.stats.InFlight--
+
+	// the interval is counted from the end of the request, as a long answer
+	// uses the provider quota until it is done
+	if next := time.Now().Add(l.cfg.MinInterval); l.cfg.MinInterval > 0 && next.After(l.next) {
+		l.next = next
+	}
+	l.mu.Unlock()
+}
+
+// Stats returns a snapshot of the statistics.
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.stats
+}
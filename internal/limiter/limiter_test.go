@@ -0,0 +1,63 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const interval = 50 * time.Millisecond
+
+func TestIntervalAfterEnd(t *testing.T) {
+	l := New(Config{MaxConcurrency: 1, MinInterval: interval})
+
+	_, release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * interval) // a long request
+	release()
+
+	wait, release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release()
+
+	if wait < interval*9/10 {
+		t.Errorf("waited %v after the end of the previous request, want %v", wait, interval)
+	}
+}
+
+func TestCancelledWaitGivesStartBack(t *testing.T) {
+	l := New(Config{MinInterval: interval})
+
+	_, release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), interval/5)
+	defer cancel()
+
+	if _, _, err := l.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Acquire = %v, want DeadlineExceeded", err)
+	}
+
+	// the cancelled request must not push the next one back by another interval
+	wait, releaseNext, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	releaseNext()
+
+	if wait > interval {
+		t.Errorf("waited %v, want the start the cancelled request gave back", wait)
+	}
+}
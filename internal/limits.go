@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"ai-proxy/internal/limiter"
+)
+
+// ProviderLimits holds max_concurrency and min_interval per provider name.
+var ProviderLimits map[string]limiter.Config
+
+// defaultProviderLimits keep the free tiers of Gemini and GigaChat from answering 429.
+var defaultProviderLimits = map[string]limiter.Config{
+	"google":   {MaxConcurrency: 1, MinInterval: 10 * time.Second},
+	"gigachat": {MaxConcurrency: 1, MinInterval: time.Second},
+}
+
+type limiterKey struct {
+	kind string // model or provider
+	name string
+}
+
+var (
+	limiters   = make(map[limiterKey]*limiter.Limiter)
+	limitersMu sync.Mutex
+)
+
+func getLimiter(key limiterKey, cfg limiter.Config) *limiter.Limiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	if limiters[key] == nil {
+		limiters[key] = limiter.New(cfg)
+	}
+
+	return limiters[key]
+}
+
+// dropLimiter makes the next request build the limiter again from the current settings.
+func dropLimiter(key limiterKey) {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	delete(limiters, key)
+}
+
+func providerLimits(provider string) limiter.Config {
+	cfg, ok := ProviderLimits[provider]
+	if !ok {
+		cfg = defaultProviderLimits[provider]
+	}
+
+	return cfg
+}
+
+// acquireModel waits for the limiters of the model and of its provider and
+// returns the function that frees them when the request is done.
+func acquireModel(ctx context.Context, model Model) (func(), error) {
+	modelLimits := limiter.Config{MaxConcurrency: model.MaxConcurrency, MinInterval: model.MinInterval}
+
+	modelWait, releaseModel, err := getLimiter(limiterKey{"model", model.Name}, modelLimits).Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	providerWait, releaseProvider, err := getLimiter(limiterKey{"provider", model.Provider}, providerLimits(model.Provider)).Acquire(ctx)
+	if err != nil {
+		releaseModel()
+
+		return nil, err
+	}
+
+	if wait := modelWait + providerWait; wait >= time.Millisecond {
+		log.Printf("Queued %v for %s", wait.Round(time.Millisecond), model.Name)
+	}
+
+	return func() {
+		releaseProvider()
+		releaseModel()
+	}, nil
+}
+
+// releaseOnClose frees the limiters of a streamed response when its body is closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r releaseOnClose) Close() error {
+	defer r.release()
+
+	return r.ReadCloser.Close()
+}
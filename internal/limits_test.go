@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"testing"
+
+	"ai-proxy/internal/limiter"
+)
+
+func TestAddModelRebuildsLimiter(t *testing.T) {
+	model := testModel("p/a", "p")
+	useModels(t, model)
+
+	key := limiterKey{"model", model.Name}
+	t.Cleanup(func() { dropLimiter(key) })
+
+	first := getLimiter(key, limiter.Config{})
+
+	AddModel(model)
+
+	if getLimiter(key, limiter.Config{}) != first {
+		t.Fatal("an unchanged model must keep its limiter")
+	}
+
+	model.MaxConcurrency = 2
+	AddModel(model)
+
+	if getLimiter(key, limiter.Config{MaxConcurrency: 2}) == first {
+		t.Fatal("a new max_concurrency must rebuild the limiter")
+	}
+}
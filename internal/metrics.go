@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"ai-proxy/internal/limiter"
+)
+
+type limiterMetric struct {
+	key   limiterKey
+	stats limiter.Stats
+}
+
+// HandlerMetrics exposes the limiter statistics in the Prometheus text format.
+func HandlerMetrics(w http.ResponseWriter, req *http.Request) {
+	var metrics []limiterMetric
+
+	limitersMu.Lock()
+
+	for key, l := range limiters {
+		metrics = append(metrics, limiterMetric{key: key, stats: l.Stats()})
+	}
+
+	limitersMu.Unlock()
+
+	slices.SortFunc(metrics, func(a, b limiterMetric) int {
+		return cmp.Or(strings.Compare(a.key.kind, b.key.kind), strings.Compare(a.key.name, b.key.name))
+	})
+
+	var sb strings.Builder
+
+	write := func(name, typ, help string, value func(limiter.Stats) float64) {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+
+		for _, m := range metrics {
+			fmt.Fprintf(&sb, "%s{kind=%q,name=%q} %g\n", name, m.key.kind, m.key.name, value(m.stats))
+		}
+	}
+
+	write("ai_proxy_queue_wait_seconds_total", "counter", "Time requests waited for a concurrency slot or min_interval.",
+		func(s limiter.Stats) float64 { return s.WaitTime.Seconds() })
+	write("ai_proxy_queue_wait_max_seconds", "gauge", "Longest wait of a single request.",
+		func(s limiter.Stats) float64 { return s.MaxWait.Seconds() })
+	write("ai_proxy_requests_total", "counter", "Requests that passed the limiter.",
+		func(s limiter.Stats) float64 { return float64(s.Requests) })
+	write("ai_proxy_queue_waiting", "gauge", "Requests waiting in the queue now.",
+		func(s limiter.Stats) float64 { return float64(s.Waiting) })
+	write("ai_proxy_requests_in_flight", "gauge", "Requests running now.",
+		func(s limiter.Stats) float64 { return float64(s.InFlight) })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(sb.String()))
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"slices"
+	"sync"
+)
+
+// modelsMu guards Models and RateLimits once the server runs: models added or
+// removed at runtime replace the Models slice instead of changing it in place.
+var modelsMu sync.RWMutex
+
+// ModelList returns the models in use; the slice must not be changed.
+func ModelList() []Model {
+	modelsMu.RLock()
+	defer modelsMu.RUnlock()
+
+	return Models
+}
+
+func modelRateLimits(name string) []*RateLimit {
+	modelsMu.RLock()
+	defer modelsMu.RUnlock()
+
+	return RateLimits[name]
+}
+
+// AddModel registers the model or replaces the one with the same name, which
+// keeps its counters when its tokens are the same.
+func AddModel(model Model) {
+	modelsMu.Lock()
+	defer modelsMu.Unlock()
+
+	models := slices.Clone(Models)
+
+	i := slices.IndexFunc(models, func(m Model) bool { return m.Name == model.Name })
+	if i < 0 {
+		models = append(models, model)
+	} else {
+		if !slices.Equal(models[i].Tokens, model.Tokens) {
+			delete(RateLimits, model.Name)
+		}
+
+		if models[i].MaxConcurrency != model.MaxConcurrency || models[i].MinInterval != model.MinInterval {
+			dropLimiter(limiterKey{"model", model.Name})
+		}
+
+		models[i] = model
+	}
+
+	if RateLimits[model.Name] == nil {
+		RateLimits[model.Name] = NewRateLimits(model)
+	}
+
+	Models = models
+}
+
+// RemoveModel drops the model, false if there is no such model.
+func RemoveModel(name string) bool {
+	modelsMu.Lock()
+	defer modelsMu.Unlock()
+
+	models := slices.DeleteFunc(slices.Clone(Models), func(m Model) bool { return m.Name == name })
+	if len(models) == len(Models) {
+		return false
+	}
+
+	delete(RateLimits, name)
+	dropLimiter(limiterKey{"model", name})
+
+	Models = models
+
+	return true
+}
@@ -2,20 +2,23 @@ package openai
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 
+	"ai-proxy/internal/httpclient"
+
 	"github.com/tidwall/sjson"
 )
 
-func Call(providerURL, model, token string, requestBody []byte) ([]byte, error) {
+func Call(ctx context.Context, providerURL, model, token string, requestBody []byte) ([]byte, error) {
 	reqBody, err := sjson.SetBytes(requestBody, "model", model)
 	if err != nil {
 		return nil, fmt.Errorf("error in sjson.SetBytes: %w", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, providerURL, bytes.NewReader(reqBody))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, providerURL, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, err
 	}
@@ -23,7 +26,7 @@ func Call(providerURL, model, token string, requestBody []byte) ([]byte, error)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpclient.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -36,7 +39,7 @@ func Call(providerURL, model, token string, requestBody []byte) ([]byte, error)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return body, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return body, &httpclient.StatusError{Code: resp.StatusCode}
 	}
 
 	return body, nil
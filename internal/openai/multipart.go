@@ -0,0 +1,41 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"ai-proxy/internal/httpclient"
+)
+
+// CallMultipart posts a multipart form (audio transcription and the like) and
+// returns the response body with its content type.
+func CallMultipart(ctx context.Context, providerURL, token, contentType string, requestBody []byte) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, providerURL, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, "", err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	resp, err := httpclient.Client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return body, "", &httpclient.StatusError{Code: resp.StatusCode}
+	}
+
+	return body, resp.Header.Get("Content-Type"), nil
+}
@@ -0,0 +1,45 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"ai-proxy/internal/httpclient"
+
+	"github.com/tidwall/sjson"
+)
+
+// Stream sends the request like Call but returns the response unread, so the
+// caller can stream audio or events to the client. The caller closes the body.
+func Stream(ctx context.Context, providerURL, model, token string, requestBody []byte) (*http.Response, error) {
+	reqBody, err := sjson.SetBytes(requestBody, "model", model)
+	if err != nil {
+		return nil, fmt.Errorf("error in sjson.SetBytes: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, providerURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	resp, err := httpclient.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+
+		return nil, fmt.Errorf("%w, body: %s", &httpclient.StatusError{Code: resp.StatusCode}, body)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chatOptions carries per-request settings taken from HTTP headers.
+type chatOptions struct {
+	Reasoning string
+	context   *contextReport // what was removed to fit the context window
+	caller    string         // API key or client address, for fair queueing
+	maxWait   time.Duration  // X-Max-Wait, the pool max_wait when negative
+	priority  string         // high or low
+}
+
+func parseChatOptions(req *http.Request) (chatOptions, error) {
+	opts := chatOptions{
+		Reasoning: req.Header.Get("X-Reasoning-Mode"),
+		context:   &contextReport{},
+		caller:    requestCaller(req),
+		maxWait:   -1,
+	}
+
+	if opts.Reasoning != "" && !IsReasoningMode(opts.Reasoning) {
+		return opts, fmt.Errorf("unknown X-Reasoning-Mode %q, expected strip, separate or keep", opts.Reasoning)
+	}
+
+	var err error
+
+	opts.priority, err = requestPriority(req, opts.caller)
+	if err != nil {
+		return opts, err
+	}
+
+	if value := req.Header.Get("X-Max-Wait"); value != "" {
+		opts.maxWait, err = parseWait(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid X-Max-Wait %q, expected seconds or a duration like 30s", value)
+		}
+	}
+
+	return opts, nil
+}
+
+// requestCaller identifies the caller by the bearer token, or by the address without one.
+func requestCaller(req *http.Request) string {
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+func parseWait(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	wait, err := time.ParseDuration(value)
+	if err == nil && wait < 0 {
+		err = errors.New("negative wait")
+	}
+
+	return wait, err
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"log"
+	"slices"
+	"time"
+)
+
+type PoolConfig struct {
+	Overflow   string        `yaml:"overflow"`    // trim or summarize, empty returns 503 for long requests
+	HedgeDelay time.Duration `yaml:"hedge_delay"` // send the request to the next model too if the first is slower
+	QueueSize  int           `yaml:"queue_size"`  // requests waiting for a free model, 0 returns 503 at once
+	MaxWait    time.Duration `yaml:"max_wait"`    // longest wait in the queue, defaultMaxWait if 0
+}
+
+// Pools holds the settings of the SMALL and BIG pools.
+var Pools map[string]PoolConfig
+
+type hedgeResult[T any] struct {
+	response T
+	err      error
+	model    string
+	attempt  int
+}
+
+// callHedged sends the request to the best model and, if it has not answered
+// within delay, to the next one as well. The first successful answer wins and
+// the other requests are cancelled; every request counts against the rate limits.
+// After an error the next model is tried at once, up to maxAttempts models.
+func callHedged[T any](ctx context.Context, match func(Model) bool,
+	delay time.Duration, send func(ctx context.Context, modelName string) (T, error),
+) (T, error) {
+	var (
+		response T
+		err      error
+		tried    []string
+		cancels  []context.CancelFunc
+		running  int
+	)
+
+	results := make(chan hedgeResult[T], maxAttempts)
+
+	start := func() bool {
+		if len(tried) >= maxAttempts {
+			return false
+		}
+
+		modelName := nextModel(func(model Model) bool {
+			return match(model) && !slices.Contains(tried, model.Name)
+		})
+		if modelName == "" {
+			return false
+		}
+
+		attemptCtx, cancel := context.WithCancel(ctx)
+		attempt := len(cancels)
+
+		tried = append(tried, modelName)
+		cancels = append(cancels, cancel)
+		running++
+
+		go func() {
+			response, err := send(attemptCtx, modelName)
+			results <- hedgeResult[T]{response: response, err: err, model: modelName, attempt: attempt}
+		}()
+
+		return true
+	}
+
+	if !start() {
+		return response, errNoModels
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for running > 0 {
+		select {
+		case <-timer.C:
+			if start() {
+				log.Printf("No answer from %s in %v, hedging with %s", tried[0], delay, tried[len(tried)-1])
+			}
+		case res := <-results:
+			running--
+
+			reportResult(res.model, res.err)
+
+			if res.err == nil {
+				for i, cancel := range cancels {
+					if i != res.attempt {
+						cancel()
+					}
+				}
+
+				go discardResults(results, running)
+
+				return res.response, nil
+			}
+
+			log.Printf("Error sending request to %s: %v", res.model, res.err)
+
+			err = res.err
+
+			start()
+		case <-ctx.Done():
+			for _, cancel := range cancels {
+				cancel()
+			}
+
+			go discardResults(results, running)
+
+			return response, ctx.Err()
+		}
+	}
+
+	if err == nil {
+		err = errNoModels
+	}
+
+	return response, err
+}
+
+// discardResults waits for the cancelled requests and closes the streams that were opened anyway.
+func discardResults[T any](results <-chan hedgeResult[T], running int) {
+	for range running {
+		res := <-results
+		reportResult(res.model, res.err)
+
+		if closer, ok := any(res.response).(io.Closer); ok && res.err == nil {
+			closer.Close()
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Priority classes of callers, set per API key in the config or with the X-Priority header.
+const (
+	PriorityHigh = "high" // interactive traffic, may use the whole quota
+	PriorityLow  = "low"  // batch jobs, leave the reserved share of the quota
+)
+
+type PriorityConfig struct {
+	Reserve float64           `yaml:"reserve"` // share of requests_per_minute kept for high priority, 0..1
+	Default string            `yaml:"default"` // class of untagged requests, high by default
+	Keys    map[string]string `yaml:"keys"`    // API key -> class, wins over X-Priority
+}
+
+var Priority PriorityConfig
+
+func IsPriority(class string) bool {
+	return class == PriorityHigh || class == PriorityLow
+}
+
+// requestPriority returns the class of the API key, the X-Priority header or the default one.
+func requestPriority(req *http.Request, caller string) (string, error) {
+	if class, ok := Priority.Keys[caller]; ok {
+		return class, nil
+	}
+
+	if class := req.Header.Get("X-Priority"); class != "" {
+		if !IsPriority(class) {
+			return "", fmt.Errorf("unknown X-Priority %q, expected high or low", class)
+		}
+
+		return class, nil
+	}
+
+	if Priority.Default != "" {
+		return Priority.Default, nil
+	}
+
+	return PriorityHigh, nil
+}
+
+// minuteBudget returns the requests per minute of the model open to the class.
+func minuteBudget(model Model, class string) int {
+	if class != PriorityLow || Priority.Reserve <= 0 {
+		return model.RequestsPerMin
+	}
+
+	return model.RequestsPerMin - int(math.Ceil(float64(model.RequestsPerMin)*Priority.Reserve))
+}
+
+// withinBudget reports whether the class has requests of the model left this minute.
+func withinBudget(model Model, class string) bool {
+	budget := minuteBudget(model, class)
+	if budget == model.RequestsPerMin {
+		return true // checked by selectModel
+	}
+
+	now := time.Now()
+
+	for _, limit := range modelRateLimits(model.Name) {
+		limit.mux.Lock()
+		updateLimitCounters(limit, now)
+		left := limit.minuteCount < budget && !now.Before(limit.blockedUntil)
+		limit.mux.Unlock()
+
+		if left {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"ai-proxy/internal/gigachat"
+	"ai-proxy/internal/httpclient"
+	"ai-proxy/internal/limiter"
+	"ai-proxy/internal/tokenizer"
+)
+
+// ProviderConfig holds the settings shared by the models of a provider; a model
+// referencing the provider by name sets only what differs.
+type ProviderConfig struct {
+	URL             string            `yaml:"url"`     // base URL, the model endpoints are derived from it
+	Auth            string            `yaml:"auth"`    // bearer (default), none or the header that carries the token
+	Headers         map[string]string `yaml:"headers"` // sent with every request, model headers win
+	Token           string            `yaml:"token"`
+	Tokens          []string          `yaml:"tokens"`
+	TokenSelection  string            `yaml:"token_selection"`
+	RequestsPerMin  int               `yaml:"requests_per_minute"` // of all models together, and of each model without its own limits
+	RequestsPerHour int               `yaml:"requests_per_hour"`
+	RequestsPerDay  int               `yaml:"requests_per_day"`
+	Timeout         time.Duration     `yaml:"timeout"`
+	ConnectTimeout  time.Duration     `yaml:"connect_timeout"`
+	limiter.Config  `yaml:",inline"`  // max_concurrency and min_interval shared by all models of the provider
+	Discovery       *DiscoveryConfig  `yaml:"discovery"` // register the models of the provider catalog
+}
+
+// Providers holds the providers blocks of the config, for models added at runtime.
+var Providers map[string]ProviderConfig
+
+// knownProviders are the providers the proxy can call without a providers
+// block; other names need one and are called as OpenAI compatible.
+var knownProviders = []string{
+	"aimlapi", "airforce", "arliai", "cloudflare", "cohere", "gigachat", "github", "glama",
+	"google", "groq", "huggingface", "openai", "openrouter", "salute", "together",
+}
+
+func IsKnownProvider(name string) bool {
+	return slices.Contains(knownProviders, name)
+}
+
+// endpointPaths are appended to the base URL of an OpenAI compatible provider by model type.
+var endpointPaths = map[string]string{
+	ModelTypeChat:      "/chat/completions",
+	ModelTypeImage:     "/images/generations",
+	ModelTypeEmbedding: "/embeddings",
+	ModelTypeAudio:     "/audio/transcriptions",
+	ModelTypeSpeech:    "/audio/speech",
+}
+
+// ApplyProvider fills the fields the model leaves empty from its provider. A
+// model url starting with / is a path under the provider url.
+func ApplyProvider(model Model, provider ProviderConfig) Model {
+	switch {
+	case model.URL == "":
+		model.URL = endpointURL(strings.TrimSuffix(provider.URL, "/"), model)
+	case strings.HasPrefix(model.URL, "/"):
+		model.URL = strings.TrimSuffix(provider.URL, "/") + model.URL
+	}
+
+	if model.Token == "" && len(model.Tokens) == 0 {
+		model.Token = provider.Token
+		model.Tokens = provider.Tokens
+	}
+
+	if len(provider.Headers) > 0 {
+		headers := maps.Clone(provider.Headers)
+		maps.Copy(headers, model.Headers)
+		model.Headers = headers
+	}
+
+	if model.RequestsPerMin == 0 && model.RequestsPerHour == 0 && model.RequestsPerDay == 0 {
+		model.RequestsPerMin = provider.RequestsPerMin
+		model.RequestsPerHour = provider.RequestsPerHour
+		model.RequestsPerDay = provider.RequestsPerDay
+	}
+
+	model.TokenSelection = cmp.Or(model.TokenSelection, provider.TokenSelection)
+	model.Auth = cmp.Or(model.Auth, provider.Auth)
+	model.Timeout = cmp.Or(model.Timeout, provider.Timeout)
+	model.ConnectTimeout = cmp.Or(model.ConnectTimeout, provider.ConnectTimeout)
+
+	return model
+}
+
+// endpointURL returns the endpoint of the model under the base URL of its provider.
+func endpointURL(base string, model Model) string {
+	if base == "" {
+		return ""
+	}
+
+	switch model.Provider {
+	case "gigachat", "google":
+		// the clients add the method themselves
+		return base
+	case "cloudflare":
+		// Workers AI: base is .../accounts/ACCOUNT_ID/ai/run
+		return base + "/@cf/" + strings.TrimPrefix(model.Name, model.Provider+"/")
+	case "salute":
+		return base + "/text:synthesize"
+	}
+
+	return base + endpointPaths[model.Type]
+}
+
+// PrepareModel fills the model from its provider and checks it, returning all
+// problems found at once.
+func PrepareModel(model Model, providers map[string]ProviderConfig) (Model, error) {
+	var errs []error
+
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	// image and other models must say so, chat models may leave the type out
+	model.Type = cmp.Or(model.Type, ModelTypeChat)
+
+	if !IsModelType(model.Type) {
+		fail("model %s has unknown type %q", model.Name, model.Type)
+	}
+
+	provider, defined := providers[model.Provider]
+
+	switch {
+	case model.Provider == "":
+		fail("model %s has no provider", model.Name)
+	case defined:
+		model = ApplyProvider(model, provider)
+	case !IsKnownProvider(model.Provider):
+		fail("model %s has unknown provider %q, add it to providers if it is OpenAI compatible", model.Name, model.Provider)
+	case model.URL == "" || strings.HasPrefix(model.URL, "/"):
+		fail("model %s has no full url and provider %s is not in providers", model.Name, model.Provider)
+	}
+
+	if model.URL == "" {
+		fail("model %s has no url and provider %s has no url to derive it from", model.Name, model.Provider)
+	} else if err := CheckURL(model.URL); err != nil {
+		fail("model %s: %v", model.Name, err)
+	}
+
+	if len(model.Tokens) > 0 {
+		model.Token = model.Tokens[0]
+	}
+
+	if model.Token == "" && model.Auth != httpclient.AuthNone && model.Provider != "airforce" {
+		fail("model %s has no token, set auth: none for providers without one", model.Name)
+	}
+
+	if model.RequestsPerMin <= 0 || model.RequestsPerHour <= 0 || model.RequestsPerDay <= 0 {
+		fail("model %s needs requests_per_minute, requests_per_hour and requests_per_day above zero", model.Name)
+	}
+
+	if model.Size != "" && model.Size != "SMALL" && model.Size != "BIG" {
+		fail("model %s has unknown model_size %q, expected SMALL or BIG", model.Name, model.Size)
+	}
+
+	if model.Reasoning != "" && !IsReasoningMode(model.Reasoning) {
+		fail("model %s has unknown reasoning mode %q", model.Name, model.Reasoning)
+	}
+
+	if model.Tokenizer != "" && !tokenizer.Known(model.Tokenizer) {
+		fail("model %s has unknown tokenizer %q", model.Name, model.Tokenizer)
+	}
+
+	if model.TokenSelection != "" && !IsTokenSelection(model.TokenSelection) {
+		fail("model %s has unknown token_selection %q", model.Name, model.TokenSelection)
+	}
+
+	// only the format is checked here, access tokens are fetched on the first request with each token
+	if model.Provider == "gigachat" {
+		tokens := model.Tokens
+		if len(tokens) == 0 {
+			tokens = []string{model.Token}
+		}
+
+		for i, token := range tokens {
+			if _, _, err := gigachat.ParseToken(token); err != nil {
+				fail("model %s: bad gigachat token %d: %v", model.Name, i+1, err)
+			}
+		}
+	}
+
+	return model, errors.Join(errs...)
+}
+
+func CheckURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("bad url: %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("bad url %q, expected http(s)://host/...", raw)
+	}
+
+	return nil
+}
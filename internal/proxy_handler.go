@@ -2,17 +2,21 @@ package internal
 
 import (
 	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"ai-proxy/internal/gemini"
 	"ai-proxy/internal/gigachat"
+	"ai-proxy/internal/httpclient"
 	"ai-proxy/internal/openai"
 	"ai-proxy/internal/schema"
 
@@ -21,41 +25,77 @@ import (
 )
 
 type RateLimit struct {
-	minuteCount int
-	hourCount   int
-	dayCount    int
-	lastMinute  time.Time
-	lastHour    time.Time
-	lastDay     time.Time
-	lastRequest time.Time
-	mux         sync.Mutex // Fine-grained locking for each rate limit
+	minuteCount  int
+	hourCount    int
+	dayCount     int
+	lastMinute   time.Time
+	lastHour     time.Time
+	lastDay      time.Time
+	lastRequest  time.Time
+	blockedUntil time.Time  // the provider refused the token
+	mux          sync.Mutex // Fine-grained locking for each rate limit
 }
 
+// Model types select which endpoint a model serves.
+const (
+	ModelTypeChat      = "chat"
+	ModelTypeImage     = "image"
+	ModelTypeEmbedding = "embedding"
+	ModelTypeAudio     = "audio"  // speech to text
+	ModelTypeSpeech    = "speech" // text to speech
+)
+
+func IsModelType(typ string) bool {
+	switch typ {
+	case ModelTypeChat, ModelTypeImage, ModelTypeEmbedding, ModelTypeAudio, ModelTypeSpeech:
+		return true
+	}
+
+	return false
+}
+
+// maxAttempts is the number of models tried for a single pooled request.
+const maxAttempts = 5
+
+// defaultTimeout limits provider calls of models without a timeout.
+const defaultTimeout = 3 * time.Minute
+
+var errNoModels = errors.New("no available models")
+
 type Model struct {
-	Name             string `yaml:"name"`
-	Provider         string `yaml:"provider"`
-	Priority         int    `yaml:"priority"`
-	RequestsPerMin   int    `yaml:"requests_per_minute"`
-	RequestsPerHour  int    `yaml:"requests_per_hour"`
-	RequestsPerDay   int    `yaml:"requests_per_day"`
-	URL              string `yaml:"url"`
-	Token            string `yaml:"token"`
-	MaxRequestLength int    `yaml:"max_request_length"`
-	Size             string `yaml:"model_size"`
+	Name             string            `yaml:"name"`
+	Type             string            `yaml:"type"`
+	Provider         string            `yaml:"provider"`
+	Priority         int               `yaml:"priority"`
+	RequestsPerMin   int               `yaml:"requests_per_minute"`
+	RequestsPerHour  int               `yaml:"requests_per_hour"`
+	RequestsPerDay   int               `yaml:"requests_per_day"`
+	URL              string            `yaml:"url"`
+	Token            string            `yaml:"token"`
+	Tokens           []string          `yaml:"tokens"`          // several accounts, each with the limits of the model
+	TokenSelection   string            `yaml:"token_selection"` // least_used (default) or round_robin
+	Auth             string            `yaml:"auth"`            // bearer (default), none or the header that carries the token
+	Headers          map[string]string `yaml:"headers"`         // sent with every request to the provider
+	MaxRequestLength int               `yaml:"max_request_length"`
+	Size             string            `yaml:"model_size"`
+	Reasoning        string            `yaml:"reasoning"`       // strip (default), separate or keep
+	OmitsThinkTag    bool              `yaml:"omits_think_tag"` // reasoning starts without <think>, streams are held until </think>
+	SupportsN        bool              `yaml:"supports_n"`      // provider returns several choices for n > 1
+	ContextWindow    int               `yaml:"context_window"`  // tokens, prompt plus max_tokens; replaces max_request_length
+	Tokenizer        string            `yaml:"tokenizer"`       // cl100k_base, o200k_base or estimate, by model name by default
+	Timeout          time.Duration     `yaml:"timeout"`         // whole provider call, defaultTimeout if 0
+	ConnectTimeout   time.Duration     `yaml:"connect_timeout"` // new connections, httpclient.DefaultConnectTimeout if 0
+	MaxConcurrency   int               `yaml:"max_concurrency"` // requests in flight, unlimited if 0
+	MinInterval      time.Duration     `yaml:"min_interval"`    // between request starts
+	Disabled         bool              `yaml:"disabled"`        // kept out of routing and direct requests
 }
 
 var (
-	RateLimits map[string]*RateLimit
+	RateLimits map[string][]*RateLimit // per model, one per token
 	Models     []Model
 )
 
 func HandlerTxt(w http.ResponseWriter, req *http.Request) {
-	var (
-		modelName, modelSize string
-		response             []byte
-		err                  error
-	)
-
 	if req.Method != http.MethodPost {
 		http.Error(w, "", http.StatusServiceUnavailable)
 
@@ -75,115 +115,261 @@ func HandlerTxt(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	modelName = gjson.GetBytes(reqBodyBytes, "model").String()
+	opts, err := parseChatOptions(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if err := checkChoices(reqBodyBytes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
 
+	_, structured := getOutputSchema(reqBodyBytes)
+	validated := structured && StructuredOutput.MaxAttempts > 0
+	stream := gjson.GetBytes(reqBodyBytes, "stream").Bool()
+
+	if stream && !validated {
+		streamChat(req.Context(), w, reqBodyBytes, opts)
+
+		return
+	}
+
+	response, err := completeChat(req.Context(), reqBodyBytes, opts)
+	if err != nil {
+		writeChatError(w, err)
+
+		return
+	}
+
+	opts.context.writeHeaders(w)
+
+	// structured output is validated on the whole answer, which is then replayed as a stream
+	if stream {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		writeChatStream(w, response)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// completeChat sends a chat completions request to the requested model, or to
+// the SMALL/BIG pool when the model name is a pool alias.
+func completeChat(ctx context.Context, reqBodyBytes []byte, opts chatOptions) ([]byte, error) {
 	// Replace stream = false
 	if gjson.GetBytes(reqBodyBytes, "stream").Bool() {
 		reqBodyBytes, _ = sjson.SetBytes(reqBodyBytes, "stream", false)
 	}
 
-	if len(modelName) < 10 {
-		if modelName != "BIG" {
-			modelSize = "SMALL"
+	response, err := completeOne(ctx, reqBodyBytes, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	n := int(gjson.GetBytes(reqBodyBytes, "n").Int())
+	if missing := n - int(gjson.GetBytes(response, "choices.#").Int()); missing > 0 {
+		return fanOutChoices(ctx, reqBodyBytes, response, missing, opts)
+	}
+
+	return response, nil
+}
+
+// completeOne makes a single call of the chat pipeline, validating structured output when requested.
+func completeOne(ctx context.Context, reqBodyBytes []byte, opts chatOptions) ([]byte, error) {
+	if schema, ok := getOutputSchema(reqBodyBytes); ok && StructuredOutput.MaxAttempts > 0 {
+		return completeStructured(ctx, reqBodyBytes, schema, opts)
+	}
+
+	response, _, err := routeChat(ctx, reqBodyBytes, nil, opts)
+
+	return response, err
+}
+
+// routeChat sends the request to the named model or to its pool, skipping the
+// excluded models, and returns the response with the name of the model used.
+func routeChat(ctx context.Context, reqBodyBytes []byte, exclude []string, opts chatOptions) ([]byte, string, error) {
+	response, err := routeModel(ctx, reqBodyBytes, exclude, opts, func(ctx context.Context, modelName string, body []byte) (modelResponse, error) {
+		response, err := sendRequestToLLM(ctx, modelName, body, opts)
+
+		return modelResponse{body: response, model: modelName}, err
+	})
+
+	return response.body, response.model, err
+}
+
+// routeModel calls send for the model named in the request, or for the models of
+// the SMALL/BIG pool when the name is a pool alias. A request too long for every
+// model of the pool is shortened according to the pool overflow policy.
+func routeModel[T any](ctx context.Context, reqBodyBytes []byte, exclude []string, opts chatOptions,
+	send func(ctx context.Context, modelName string, reqBodyBytes []byte) (T, error),
+) (T, error) {
+	var modelSize string
+
+	modelName := gjson.GetBytes(reqBodyBytes, "model").String()
+
+	if len(modelName) >= 10 {
+		return send(ctx, modelName, reqBodyBytes)
+	}
+
+	if modelName != "BIG" {
+		modelSize = "SMALL"
+	} else {
+		modelSize = "BIG"
+	}
+
+	inPool := func(model Model) bool {
+		return model.Type == ModelTypeChat && model.Size == modelSize && !slices.Contains(exclude, model.Name)
+	}
+
+	size := newRequestSize(reqBodyBytes)
+
+	// with all models busy the request waits in the pool queue, if the pool has one
+	taken := waitForModel(ctx, modelSize, func(model Model) bool {
+		return inPool(model) && (Pools[modelSize].Overflow != "" || size.fits(model))
+	}, opts)
+	defer taken()
+
+	if policy := Pools[modelSize].Overflow; policy != "" && !size.fitsAny(inPool) && selectModel(inPool) != "" {
+		body, err := fitContext(ctx, reqBodyBytes, inPool, policy, opts.context)
+		if err != nil {
+			log.Printf("Error fitting the context into %s: %v", modelSize, err)
 		} else {
-			modelSize = "BIG"
+			reqBodyBytes = body
+			size = newRequestSize(body)
 		}
+	}
 
-		for i := 0; i < 5; i++ {
-			modelName = selectModel(modelSize, len(reqBodyBytes))
-			if modelName == "" {
-				log.Printf("No available models for this request length = %d", len(reqBodyBytes))
-				http.Error(w, "No available models for this request length", http.StatusServiceUnavailable)
+	match := func(model Model) bool {
+		return inPool(model) && size.fits(model) && withinBudget(model, opts.priority)
+	}
 
-				return
-			}
+	sendBody := func(ctx context.Context, modelName string) (T, error) {
+		taken()
 
-			response, err = sendRequestToLLM(modelName, reqBodyBytes)
-			if err != nil {
-				setMaxLimitMinute(modelName) // set max minuteCount for pause after error
-				log.Printf("Error sending request to LLM: %v", err)
+		return send(ctx, modelName, reqBodyBytes)
+	}
 
-				continue
-			}
+	var (
+		response T
+		err      error
+	)
 
-			break
-		}
+	if delay := Pools[modelSize].HedgeDelay; delay > 0 {
+		response, err = callHedged(ctx, match, delay, sendBody)
 	} else {
-		response, err = sendRequestToLLM(modelName, reqBodyBytes)
+		response, err = callWithFailover(match, func(modelName string) (T, error) {
+			return sendBody(ctx, modelName)
+		})
 	}
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-
-		return
+	if errors.Is(err, errNoModels) {
+		log.Printf("No available models for this request length = %d, max_tokens = %d", size.length, size.maxTokens)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(response)
+	return response, err
+}
+
+type modelResponse struct {
+	body  []byte
+	model string
 }
 
-func setMaxLimitMinute(modelName string) {
-	var model Model
+// writeChatError answers with the HTTP status matching a chat pipeline error.
+func writeChatError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNoModels):
+		http.Error(w, "No available models for this request length", http.StatusServiceUnavailable)
+	case errors.Is(err, errStructuredOutput):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-	for _, m := range Models {
-		if m.Name == modelName {
-			model = m
+// callWithFailover sends the request to the best model matching the filter,
+// moving on to the next one after an error, up to maxAttempts models.
+func callWithFailover[T any](match func(Model) bool, send func(modelName string) (T, error)) (T, error) {
+	var (
+		response T
+		err      error
+	)
 
-			break
+	for range maxAttempts {
+		modelName := nextModel(match)
+		if modelName == "" {
+			if err == nil {
+				err = errNoModels
+			}
+
+			return response, err
 		}
-	}
 
-	limit := RateLimits[modelName]
+		response, err = send(modelName)
+		reportResult(modelName, err)
 
-	limit.mux.Lock()
-	defer limit.mux.Unlock()
+		if errors.Is(err, context.Canceled) {
+			return response, err // the client went away
+		}
+
+		if err != nil {
+			log.Printf("Error sending request to %s: %v", modelName, err)
+
+			continue
+		}
 
-	limit.minuteCount = model.RequestsPerMin + 1
-	limit.lastMinute = time.Now()
+		return response, nil
+	}
+
+	return response, err
 }
 
-func selectModel(modelSize string, requestLength int) string {
+func fitsRequestLength(model Model, requestLength int) bool {
+	return model.MaxRequestLength == 0 || requestLength <= model.MaxRequestLength
+}
+
+// selectModel returns the name of the healthy model with quota left and closed
+// circuits among those accepted by match, preferring lower priority values.
+func selectModel(match func(Model) bool) string {
 	var selectedModel *Model
 
 	var selectedLastRequest time.Time
 
-	for _, model := range Models {
-		if model.Size != modelSize {
-			continue
-		}
+	now := time.Now()
 
-		if requestLength > model.MaxRequestLength {
+	for _, model := range ModelList() {
+		if model.Disabled || !match(model) || !isHealthy(model.Name) || !circuitAllows(model, now) {
 			continue
 		}
 
-		limit := RateLimits[model.Name]
-		limit.mux.Lock() // Lock individual rate limit
-
-		if limit.minuteCount < model.RequestsPerMin &&
-			limit.hourCount < model.RequestsPerHour &&
-			limit.dayCount < model.RequestsPerDay {
+		lastRequest, ok := tokenWithQuota(model, now)
+		if ok {
 			// Select the model with the lowest priority
 			// If priorities are equal, select the one with the earliest lastRequest
 			if selectedModel == nil {
 				selectedModel = &model
-				selectedLastRequest = limit.lastRequest
+				selectedLastRequest = lastRequest
 			} else if model.Priority < selectedModel.Priority {
 				selectedModel = &model
-				selectedLastRequest = limit.lastRequest
+				selectedLastRequest = lastRequest
 			} else if model.Priority == selectedModel.Priority {
-				// && limit.lastRequest.Before(selectedLastRequest) {
-				if limit.lastRequest.Before(time.Now().Add(-time.Hour)) && selectedLastRequest.Before(time.Now().Add(-time.Hour)) &&
+				// && lastRequest.Before(selectedLastRequest) {
+				if lastRequest.Before(time.Now().Add(-time.Hour)) && selectedLastRequest.Before(time.Now().Add(-time.Hour)) &&
 					model.MaxRequestLength < selectedModel.MaxRequestLength {
 					selectedModel = &model
-					selectedLastRequest = limit.lastRequest
-				} else if limit.lastRequest.Before(selectedLastRequest) {
+					selectedLastRequest = lastRequest
+				} else if lastRequest.Before(selectedLastRequest) {
 					selectedModel = &model
-					selectedLastRequest = limit.lastRequest
+					selectedLastRequest = lastRequest
 				}
 			}
 		}
-
-		limit.mux.Unlock()
 	}
 
 	if selectedModel == nil {
@@ -210,27 +396,19 @@ func updateLimitCounters(limit *RateLimit, now time.Time) {
 	}
 }
 
-func incrementRateLimit(modelName string) {
-	limit := RateLimits[modelName]
-
-	limit.mux.Lock()
-	defer limit.mux.Unlock()
-
-	now := time.Now()
-
-	updateLimitCounters(limit, now)
+// getModelByName returns the model with the token for the request, counting the request against it.
+func getModelByName(modelName string) (Model, bool) {
+	model, found := findModel(modelName)
+	if !found || model.Disabled {
+		return model, false
+	}
 
-	limit.minuteCount++
-	limit.hourCount++
-	limit.dayCount++
-	limit.lastRequest = now
+	return pickToken(model), true
 }
 
-func getModelByName(modelName string) (Model, bool) {
-	for _, model := range Models {
+func findModel(modelName string) (Model, bool) {
+	for _, model := range ModelList() {
 		if model.Name == modelName {
-			incrementRateLimit(modelName)
-
 			return model, true
 		}
 	}
@@ -238,68 +416,123 @@ func getModelByName(modelName string) (Model, bool) {
 	return Model{}, false
 }
 
-func getRequestLength(requestBody schema.RequestOpenAICompatable) int {
-	var res int
+// getRequestLength returns the size of the request, counting image and audio
+// parts as schema.AttachmentLength instead of their base64 data.
+func getRequestLength(reqBodyBytes []byte) int {
+	res := len(reqBodyBytes)
 
-	for _, v := range requestBody.Messages {
-		res += len(v.Content)
+	for _, content := range gjson.GetBytes(reqBodyBytes, "messages.#.content").Array() {
+		if !content.IsArray() {
+			continue
+		}
+
+		for _, part := range content.Array() {
+			if part.Get("type").String() != "text" {
+				res += schema.AttachmentLength - len(part.Raw)
+			}
+		}
 	}
 
 	return res
 }
 
+// messageText returns the text of a message content, skipping attachments.
+func messageText(content gjson.Result) string {
+	if !content.IsArray() {
+		return content.String()
+	}
+
+	var texts []string
+
+	for _, part := range content.Array() {
+		if part.Get("type").String() == "text" {
+			texts = append(texts, part.Get("text").String())
+		}
+	}
+
+	return strings.Join(texts, "\n")
+}
+
 // func sendRequestToLLM(modelName string, requestBody schema.RequestOpenAICompatable) ([]byte, error) {
-func sendRequestToLLM(modelName string, requestBody []byte) ([]byte, error) {
+func sendRequestToLLM(ctx context.Context, modelName string, requestBody []byte, opts chatOptions) ([]byte, error) {
 	var resp []byte
 
 	var err error
 
-	log.Printf("Request to model: %s - %s\n", modelName, printFirstChars(gjson.GetBytes(requestBody, "messages.0.content").String()))
+	log.Printf("Request to model: %s - %s\n", modelName, printFirstChars(messageText(gjson.GetBytes(requestBody, "messages.0.content"))))
 
 	model, found := getModelByName(modelName)
 	if !found {
 		return nil, fmt.Errorf("Specified model not found - %s", modelName)
 	}
 
-	switch model.Provider {
-	case "cloudflare":
-		resp, err = openai.Call(model.URL, "@"+model.Name, model.Token, requestBody)
-	case "google": // todo change on openai.Call - https://developers.googleblog.com/en/gemini-is-now-accessible-from-the-openai-library/
-		resp, err = gemini.Call(model.URL, model.Name, model.Token, requestBody)
-	case "gigachat":
-		resp, err = gigachat.Call(model.URL, strings.TrimPrefix(model.Name, model.Provider+"/"), model.Token, requestBody)
-	case "groq", "arliai", "github":
-		resp, err = openai.Call(model.URL, strings.TrimPrefix(model.Name, model.Provider+"/"), model.Token, requestBody)
-	case "cohere":
-		resp, err = openai.Call(model.URL, strings.TrimPrefix(model.Name, model.Provider+"/"), model.Token, requestBody)
-		if err == nil {
-			response := schema.ResponseOpenAICompatable{
-				Model: model.Name,
-				Choices: []struct {
-					Index   int `json:"index,omitempty"`
-					Message struct {
-						Role    string `json:"role,omitempty"`
-						Content string `json:"content,omitempty"`
-					} `json:"message,omitempty"`
-					FinishReason string `json:"finish_reason,omitempty"`
-				}{
-					{
-						Index: 0,
-						Message: struct {
+	release, err := acquireModel(ctx, model)
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	ctx, cancel := modelContext(ctx, model)
+	defer cancel()
+
+	// the missing choices are requested separately by completeChat
+	if gjson.GetBytes(requestBody, "n").Int() > 1 && !supportsN(model) {
+		requestBody, err = sjson.DeleteBytes(requestBody, "n")
+		if err != nil {
+			return nil, fmt.Errorf("error in sjson.DeleteBytes: %w", err)
+		}
+	}
+
+	for {
+		switch model.Provider {
+		case "cloudflare":
+			resp, err = openai.Call(ctx, model.URL, providerModelName(model), model.Token, requestBody)
+		case "google": // todo change on openai.Call - https://developers.googleblog.com/en/gemini-is-now-accessible-from-the-openai-library/
+			resp, err = gemini.Call(ctx, model.URL, model.Name, model.Token, requestBody)
+		case "gigachat":
+			resp, err = gigachat.Call(ctx, model.URL, strings.TrimPrefix(model.Name, model.Provider+"/"), model.Token, requestBody)
+		case "groq", "arliai", "github":
+			resp, err = openai.Call(ctx, model.URL, providerModelName(model), model.Token, requestBody)
+		case "cohere":
+			resp, err = openai.Call(ctx, model.URL, strings.TrimPrefix(model.Name, model.Provider+"/"), model.Token, requestBody)
+			if err == nil {
+				response := schema.ResponseOpenAICompatable{
+					Model: model.Name,
+					Choices: []struct {
+						Index   int `json:"index,omitempty"`
+						Message struct {
 							Role    string `json:"role,omitempty"`
 							Content string `json:"content,omitempty"`
-						}{
-							Role:    "assistant",
-							Content: gjson.GetBytes(resp, "message.content.0.text").String(),
+						} `json:"message,omitempty"`
+						FinishReason string `json:"finish_reason,omitempty"`
+					}{
+						{
+							Index: 0,
+							Message: struct {
+								Role    string `json:"role,omitempty"`
+								Content string `json:"content,omitempty"`
+							}{
+								Role:    "assistant",
+								Content: gjson.GetBytes(resp, "message.content.0.text").String(),
+							},
+							FinishReason: "stop",
 						},
-						FinishReason: "stop",
 					},
-				},
+				}
+				resp, err = json.Marshal(response)
 			}
-			resp, err = json.Marshal(response)
+		default:
+			resp, err = openai.Call(ctx, model.URL, providerModelName(model), model.Token, requestBody)
 		}
-	default:
-		resp, err = openai.Call(model.URL, strings.TrimPrefix(model.Name, model.Provider+"/"), model.Token, requestBody)
+
+		// the provider refused the token, the model may have another one
+		next, ok := retryToken(model, err)
+		if !ok {
+			break
+		}
+
+		model = next
 	}
 
 	if err != nil {
@@ -312,25 +545,74 @@ func sendRequestToLLM(modelName string, requestBody []byte) ([]byte, error) {
 		return nil, fmt.Errorf("No response from LLM")
 	}
 
-	content := gjson.GetBytes(resp, "choices.0.message.content").String()
-	log.Printf("Response: %s\n", printFirstChars(cmp.Or(content, string(resp))))
+	content := firstContent(resp)
+	log.Printf("Response (%d choices): %s\n", gjson.GetBytes(resp, "choices.#").Int(), printFirstChars(cmp.Or(content, string(resp))))
 
 	if len(content) == 0 {
 		return nil, fmt.Errorf("no content")
 	}
 
-	// replace block <think>...</think> in reasoning models
-	index := strings.Index(content, "</think>")
-	if index != -1 {
-		content = content[index+len("</think>"):]
+	// handle block <think>...</think> in reasoning models
+	return processReasoning(resp, reasoningMode(model, opts))
+}
 
-		resp, err = sjson.SetBytes(resp, "choices.0.message.content", strings.TrimSpace(content))
-		if err != nil {
-			return nil, fmt.Errorf("error sjson.SetBytes in replace think: %w", err)
+// firstContent returns the first non-empty message content among the choices.
+func firstContent(resp []byte) string {
+	for _, choice := range gjson.GetBytes(resp, "choices").Array() {
+		if content := choice.Get("message.content").String(); content != "" {
+			return content
 		}
 	}
 
-	return resp, nil
+	return ""
+}
+
+// supportsN reports whether the provider returns n choices in a single call.
+func supportsN(model Model) bool {
+	return model.SupportsN || model.Provider == "google" || model.Provider == "gigachat"
+}
+
+// modelContext limits a provider call by the model timeout and connect timeout.
+func modelContext(ctx context.Context, model Model) (context.Context, context.CancelFunc) {
+	ctx = providerContext(ctx, model)
+
+	return context.WithTimeout(ctx, cmp.Or(model.Timeout, defaultTimeout))
+}
+
+// streamContext limits a streaming call by the model timeout until stop is called
+// once the response headers have arrived; the stream then lasts while the client reads.
+func streamContext(ctx context.Context, model Model) (context.Context, func() bool) {
+	ctx = providerContext(ctx, model)
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(cmp.Or(model.Timeout, defaultTimeout), cancel)
+
+	return ctx, timer.Stop
+}
+
+// providerContext passes the connect timeout, auth style and headers of the model to the HTTP client.
+func providerContext(ctx context.Context, model Model) context.Context {
+	ctx = httpclient.WithConnectTimeout(ctx, model.ConnectTimeout)
+
+	return httpclient.WithHeaders(ctx, model.Auth, model.Headers)
+}
+
+// providerModelName returns the model name expected by the provider API.
+func providerModelName(model Model) string {
+	if model.Provider == "cloudflare" {
+		return "@" + model.Name
+	}
+
+	return strings.TrimPrefix(model.Name, model.Provider+"/")
+}
+
+// isOpenAICompatible reports whether the provider is called through openai.Call and can stream.
+func isOpenAICompatible(model Model) bool {
+	switch model.Provider {
+	case "google", "gigachat", "cohere":
+		return false
+	default:
+		return true
+	}
 }
 
 func printFirstChars(data string) string {
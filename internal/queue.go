@@ -0,0 +1,252 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultMaxWait is the wait limit of a pool queue without max_wait.
+const defaultMaxWait = 30 * time.Second
+
+// queuePoll is how often a waiting queue rechecks models it cannot predict,
+// like circuits and hour or day quotas.
+const queuePoll = time.Second
+
+type waiter struct {
+	key      string
+	priority string
+	match    func(Model) bool
+	ready    chan struct{} // closed when the waiter may try the pool
+	taken    chan struct{} // closed when the waiter has sent its request
+}
+
+// waitQueue holds the requests waiting for a model of a pool, one FIFO per
+// caller, and lets them through by turns so that a batch job cannot starve others.
+type waitQueue struct {
+	mu      sync.Mutex
+	keys    []string // callers in round-robin order
+	waiters map[string][]*waiter
+	size    int
+	next    int
+	running bool
+}
+
+var (
+	queues   = make(map[string]*waitQueue)
+	queuesMu sync.Mutex
+)
+
+func poolQueue(pool string) *waitQueue {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+
+	if queues[pool] == nil {
+		queues[pool] = &waitQueue{waiters: make(map[string][]*waiter)}
+	}
+
+	return queues[pool]
+}
+
+// waitForModel waits until a model accepted by match is available, when the
+// pool has a queue and such a model exists at all. The returned taken function
+// must be called once the request has been sent to let the next waiter in.
+func waitForModel(ctx context.Context, pool string, match func(Model) bool, opts chatOptions) func() {
+	cfg := Pools[pool]
+
+	exists := match
+	match = func(model Model) bool {
+		return exists(model) && withinBudget(model, opts.priority)
+	}
+
+	maxWait := cmp.Or(cfg.MaxWait, defaultMaxWait)
+	if opts.maxWait >= 0 {
+		maxWait = min(opts.maxWait, maxWait)
+	}
+
+	q := poolQueue(pool)
+
+	q.mu.Lock()
+
+	if cfg.QueueSize == 0 || maxWait == 0 || !slices.ContainsFunc(ModelList(), exists) ||
+		q.size == 0 && selectModel(match) != "" {
+		q.mu.Unlock()
+
+		return func() {}
+	}
+
+	if q.size >= cfg.QueueSize {
+		q.mu.Unlock()
+		log.Printf("Queue of %s is full", pool)
+
+		return func() {}
+	}
+
+	w := &waiter{key: opts.caller, priority: opts.priority, match: match, ready: make(chan struct{}), taken: make(chan struct{})}
+	q.push(w)
+
+	if !q.running {
+		q.running = true
+
+		go q.dispatch()
+	}
+
+	q.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(maxWait)
+
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		log.Printf("Waited %v in the %s queue", time.Since(start).Round(time.Millisecond), pool)
+
+		var once sync.Once
+
+		return func() {
+			once.Do(func() { close(w.taken) })
+		}
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.remove(w) {
+		// let through at the same moment, hand the turn back
+		close(w.taken)
+	}
+
+	return func() {}
+}
+
+func (q *waitQueue) push(w *waiter) {
+	if len(q.waiters[w.key]) == 0 {
+		q.keys = append(q.keys, w.key)
+	}
+
+	q.waiters[w.key] = append(q.waiters[w.key], w)
+	q.size++
+}
+
+// remove drops a waiter that gave up; false if it has already been let through.
+func (q *waitQueue) remove(w *waiter) bool {
+	i := slices.Index(q.waiters[w.key], w)
+	if i < 0 {
+		return false
+	}
+
+	q.waiters[w.key] = slices.Delete(q.waiters[w.key], i, i+1)
+	q.size--
+
+	if len(q.waiters[w.key]) == 0 {
+		q.dropKey(w.key)
+	}
+
+	return true
+}
+
+func (q *waitQueue) dropKey(key string) {
+	i := slices.Index(q.keys, key)
+
+	q.keys = slices.Delete(q.keys, i, i+1)
+	delete(q.waiters, key)
+
+	if q.next > i {
+		q.next--
+	}
+}
+
+// pick takes the first waiter of the next caller in turn that has a model
+// available now, high priority callers first.
+func (q *waitQueue) pick() *waiter {
+	for _, low := range []bool{false, true} {
+		if w := q.pickClass(low); w != nil {
+			return w
+		}
+	}
+
+	return nil
+}
+
+func (q *waitQueue) pickClass(low bool) *waiter {
+	for i := range q.keys {
+		idx := (q.next + i) % len(q.keys)
+		key := q.keys[idx]
+		w := q.waiters[key][0]
+
+		if (w.priority == PriorityLow) != low || selectModel(w.match) == "" {
+			continue
+		}
+
+		q.waiters[key] = q.waiters[key][1:]
+		q.size--
+		q.next = idx + 1
+
+		if len(q.waiters[key]) == 0 {
+			q.dropKey(key)
+		}
+
+		return w
+	}
+
+	return nil
+}
+
+// dispatch lets the waiters through one by one while models are available and
+// sleeps until the next minute window of the pool models frees up otherwise.
+func (q *waitQueue) dispatch() {
+	for {
+		q.mu.Lock()
+
+		if q.size == 0 {
+			q.running = false
+			q.mu.Unlock()
+
+			return
+		}
+
+		w := q.pick()
+		q.mu.Unlock()
+
+		if w == nil {
+			time.Sleep(nextMinuteWindow())
+
+			continue
+		}
+
+		close(w.ready)
+
+		// the waiter's request counts against the limits once sent
+		select {
+		case <-w.taken:
+		case <-time.After(queuePoll):
+		}
+	}
+}
+
+// nextMinuteWindow returns the time until the first minute quota exhausted for
+// low priority resets, at most queuePoll.
+func nextMinuteWindow() time.Duration {
+	wait := queuePoll
+	now := time.Now()
+
+	for _, model := range ModelList() {
+		for _, limit := range modelRateLimits(model.Name) {
+			limit.mux.Lock()
+
+			if model.RequestsPerMin > 0 && limit.minuteCount >= minuteBudget(model, PriorityLow) {
+				wait = min(wait, limit.lastMinute.Add(time.Minute).Sub(now))
+			}
+
+			limit.mux.Unlock()
+		}
+	}
+
+	return max(wait, time.Millisecond)
+}
@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Reasoning modes for the <think> blocks of reasoning models, set per model with
+// `reasoning` or per request with the X-Reasoning-Mode header.
+const (
+	ReasoningStrip    = "strip"    // drop the reasoning (default)
+	ReasoningSeparate = "separate" // move it into message.reasoning_content like DeepSeek and OpenRouter
+	ReasoningKeep     = "keep"     // return the content verbatim
+)
+
+const (
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+)
+
+func IsReasoningMode(mode string) bool {
+	return mode == ReasoningStrip || mode == ReasoningSeparate || mode == ReasoningKeep
+}
+
+// reasoningMode returns the mode requested by the client, then the model one, strip by default.
+func reasoningMode(model Model, opts chatOptions) string {
+	switch {
+	case opts.Reasoning != "":
+		return opts.Reasoning
+	case model.Reasoning != "":
+		return model.Reasoning
+	default:
+		return ReasoningStrip
+	}
+}
+
+// processReasoning applies the reasoning mode to every choice of a chat completion.
+func processReasoning(resp []byte, mode string) ([]byte, error) {
+	if mode == ReasoningKeep {
+		return resp, nil
+	}
+
+	var err error
+
+	for i, choice := range gjson.GetBytes(resp, "choices").Array() {
+		path := fmt.Sprintf("choices.%d.message", i)
+		message := choice.Get("message")
+
+		reasoning, content := splitThink(message.Get("content").String())
+		// some providers already return the reasoning in a separate field
+		reasoning = joinReasoning(message.Get("reasoning_content").String(), message.Get("reasoning").String(), reasoning)
+
+		resp, err = setReasoning(resp, path, "content", content, reasoning, mode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+// setReasoning writes content and, in separate mode, reasoning_content under path,
+// dropping the provider specific reasoning fields.
+func setReasoning(resp []byte, path, contentField, content, reasoning, mode string) ([]byte, error) {
+	var err error
+
+	resp, err = sjson.SetBytes(resp, path+"."+contentField, content)
+	if err != nil {
+		return nil, fmt.Errorf("error sjson.SetBytes in reasoning: %w", err)
+	}
+
+	resp, err = sjson.DeleteBytes(resp, path+".reasoning")
+	if err != nil {
+		return nil, fmt.Errorf("error sjson.DeleteBytes in reasoning: %w", err)
+	}
+
+	if mode == ReasoningSeparate && reasoning != "" {
+		return sjson.SetBytes(resp, path+".reasoning_content", reasoning)
+	}
+
+	return sjson.DeleteBytes(resp, path+".reasoning_content")
+}
+
+// splitThink separates a <think>...</think> block from the answer. Some models
+// omit the opening tag, so everything up to </think> counts as reasoning.
+func splitThink(content string) (string, string) {
+	index := strings.Index(content, thinkCloseTag)
+	if index == -1 {
+		return "", content
+	}
+
+	reasoning := content[:index]
+	if start := strings.Index(reasoning, thinkOpenTag); start != -1 {
+		reasoning = reasoning[start+len(thinkOpenTag):]
+	}
+
+	return strings.TrimSpace(reasoning), strings.TrimSpace(content[index+len(thinkCloseTag):])
+}
+
+func joinReasoning(parts ...string) string {
+	var res []string
+
+	for _, v := range parts {
+		if v != "" {
+			res = append(res, v)
+		}
+	}
+
+	return strings.Join(res, "\n")
+}
+
+// thinkParser separates <think> blocks from streamed content, where a tag may be
+// split between chunks.
+type thinkParser struct {
+	inThink   bool
+	undecided bool   // no tag seen yet: hold the text, it is reasoning if </think> comes without <think>
+	trimSpace bool   // drop the whitespace right after </think>
+	pending   string // text that may be the beginning of a tag
+}
+
+// Feed returns the content and reasoning parts of the next delta.
+func (p *thinkParser) Feed(delta string) (string, string) {
+	var content, reasoning strings.Builder
+
+	buf := p.pending + delta
+	p.pending = ""
+
+	if p.undecided {
+		closing := strings.Index(buf, thinkCloseTag)
+		opening := strings.Index(buf, thinkOpenTag)
+
+		switch {
+		case closing != -1 && (opening == -1 || closing < opening):
+			// like splitThink: everything before a lone </think> is reasoning
+			reasoning.WriteString(buf[:closing])
+			buf = buf[closing+len(thinkCloseTag):]
+			p.trimSpace = true
+		case opening != -1:
+		default:
+			p.pending = buf
+
+			return "", ""
+		}
+
+		p.undecided = false
+	}
+
+	for buf != "" {
+		tag := thinkOpenTag
+		if p.inThink {
+			tag = thinkCloseTag
+		}
+
+		index := strings.Index(buf, tag)
+		if index == -1 {
+			keep := partialTagSuffix(buf, tag)
+			p.write(&content, &reasoning, buf[:len(buf)-keep])
+			p.pending = buf[len(buf)-keep:]
+
+			break
+		}
+
+		p.write(&content, &reasoning, buf[:index])
+		buf = buf[index+len(tag):]
+		p.inThink = !p.inThink
+		p.trimSpace = !p.inThink
+	}
+
+	return content.String(), reasoning.String()
+}
+
+// Flush returns the text held back at the end of the stream.
+func (p *thinkParser) Flush() (string, string) {
+	var content, reasoning strings.Builder
+
+	p.write(&content, &reasoning, p.pending)
+	p.pending = ""
+	p.undecided = false
+
+	return content.String(), reasoning.String()
+}
+
+func (p *thinkParser) write(content, reasoning *strings.Builder, text string) {
+	if p.inThink {
+		reasoning.WriteString(text)
+
+		return
+	}
+
+	if p.trimSpace {
+		text = strings.TrimLeft(text, " \t\r\n")
+		p.trimSpace = text == ""
+	}
+
+	content.WriteString(text)
+}
+
+// partialTagSuffix returns the length of the longest suffix of s that is a prefix of tag.
+func partialTagSuffix(s, tag string) int {
+	for n := min(len(s), len(tag)-1); n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,63 @@
+package internal
+
+import "testing"
+
+func TestThinkParser(t *testing.T) {
+	tests := []struct {
+		name          string
+		undecided     bool
+		chunks        []string
+		wantContent   string
+		wantReasoning string
+	}{
+		{"no tags", false, []string{"Hello", ", world"}, "Hello, world", ""},
+		{"whole block", false, []string{"<think>why</think>\n\nanswer"}, "answer", "why"},
+		{"open tag split", false, []string{"<th", "ink>why</think>answer"}, "answer", "why"},
+		{"close tag split", false, []string{"<think>why</", "thi", "nk> answer"}, "answer", "why"},
+		{"tag split byte by byte", false, []string{"<", "t", "h", "i", "n", "k", ">", "a", "<", "/", "t", "h", "i", "n", "k", ">", "b"}, "b", "a"},
+		{"text before the block", false, []string{"pre <think>x</think> post"}, "pre post", "x"},
+		{"lookalike is content", false, []string{"a <thin", "g> b"}, "a <thing> b", ""},
+		{"unfinished tag at the end", false, []string{"a <thi"}, "a <thi", ""},
+		{"unclosed block", false, []string{"<think>still thinking"}, "", "still thinking"},
+		{"lone close tag when undecided", true, []string{"reason", "ing</th", "ink>\nanswer"}, "answer", "reasoning"},
+		{"open tag when undecided", true, []string{"<think>r</think>a"}, "a", "r"},
+		{"no tag when undecided", true, []string{"just ", "content"}, "just content", ""},
+		{"lone close tag when decided", false, []string{"x</think>y"}, "x</think>y", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var content, reasoning string
+
+			p := &thinkParser{undecided: tt.undecided}
+
+			for _, chunk := range tt.chunks {
+				c, r := p.Feed(chunk)
+				content += c
+				reasoning += r
+			}
+
+			c, r := p.Flush()
+			content += c
+			reasoning += r
+
+			if content != tt.wantContent || reasoning != tt.wantReasoning {
+				t.Errorf("content %q, reasoning %q; want %q, %q", content, reasoning, tt.wantContent, tt.wantReasoning)
+			}
+		})
+	}
+}
+
+func TestThinkParserStreamsWithoutHolding(t *testing.T) {
+	p := &thinkParser{}
+
+	if content, _ := p.Feed("Hello"); content != "Hello" {
+		t.Errorf("first delta gave %q, want it passed on at once", content)
+	}
+
+	p = &thinkParser{undecided: true}
+
+	if content, _ := p.Feed("Hello"); content != "" {
+		t.Errorf("undecided parser gave %q, want the text held", content)
+	}
+}
@@ -0,0 +1,453 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tidwall/gjson"
+)
+
+// Пример запроса
+// curl http://127.0.0.1:8080/v1/responses -d '{"model": "SMALL", "input": "Tell me a joke"}'
+// curl http://127.0.0.1:8080/v1/responses -d '{"model": "SMALL", "input": "Another one", "previous_response_id": "resp_..."}'
+
+const (
+	responseStoreTTL  = 24 * time.Hour
+	responseStoreSize = 10000
+)
+
+type Response struct {
+	ID                 string           `json:"id"`
+	Object             string           `json:"object"`
+	CreatedAt          int64            `json:"created_at"`
+	Status             string           `json:"status"`
+	Model              string           `json:"model"`
+	Output             []ResponseOutput `json:"output"`
+	PreviousResponseID *string          `json:"previous_response_id"`
+	Usage              *ResponseUsage   `json:"usage,omitempty"`
+	Store              bool             `json:"store"`
+}
+
+type ResponseOutput struct {
+	Type      string                `json:"type"`
+	ID        string                `json:"id"`
+	Status    string                `json:"status"`
+	Role      string                `json:"role,omitempty"`
+	Content   []ResponseContentPart `json:"content,omitempty"`
+	CallID    string                `json:"call_id,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	Arguments string                `json:"arguments,omitempty"`
+}
+
+type ResponseContentPart struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+type ResponseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// storedResponse keeps the conversation behind a response so previous_response_id
+// works with stateless providers.
+type storedResponse struct {
+	response Response
+	messages []any
+	created  time.Time
+}
+
+var (
+	responseStore   = make(map[string]storedResponse)
+	responseStoreMu sync.Mutex
+)
+
+// HandlerResponses implements the /responses endpoint of the OpenAI Responses API
+// by translating it into a chat completions request.
+func HandlerResponses(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	reqBodyBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if !gjson.ValidBytes(reqBodyBytes) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+
+		return
+	}
+
+	opts, err := parseChatOptions(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	request := gjson.ParseBytes(reqBodyBytes)
+
+	var history []any
+
+	previousID := request.Get("previous_response_id").String()
+	if previousID != "" {
+		previous, ok := loadResponse(previousID)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Previous response with id '%s' not found", previousID), http.StatusNotFound)
+
+			return
+		}
+
+		history = previous.messages
+	}
+
+	input, err := responseInputToMessages(request.Get("input"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	// history is shared with the stored response, so never append to it in place
+	messages := append(append([]any{}, history...), input...)
+
+	chatBody, err := responseRequestToChat(request, messages)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	chatResponse, err := completeChat(req.Context(), chatBody, opts)
+	if err != nil {
+		writeChatError(w, err)
+
+		return
+	}
+
+	response, assistant := chatToResponse(chatResponse)
+	response.Store = !request.Get("store").Exists() || request.Get("store").Bool()
+
+	if previousID != "" {
+		response.PreviousResponseID = &previousID
+	}
+
+	if response.Store {
+		saveResponse(storedResponse{
+			response: response,
+			messages: append(messages, assistant),
+			created:  time.Now(),
+		})
+	}
+
+	opts.context.writeHeaders(w)
+
+	if request.Get("stream").Bool() {
+		writeResponseStream(w, response)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandlerGetResponse returns a stored response by ID.
+func HandlerGetResponse(w http.ResponseWriter, req *http.Request) {
+	stored, ok := loadResponse(req.PathValue("id"))
+	if !ok {
+		http.NotFound(w, req)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stored.response)
+}
+
+func loadResponse(id string) (storedResponse, bool) {
+	responseStoreMu.Lock()
+	defer responseStoreMu.Unlock()
+
+	stored, ok := responseStore[id]
+	if !ok || time.Since(stored.created) > responseStoreTTL {
+		return storedResponse{}, false
+	}
+
+	return stored, true
+}
+
+func saveResponse(stored storedResponse) {
+	responseStoreMu.Lock()
+	defer responseStoreMu.Unlock()
+
+	if len(responseStore) >= responseStoreSize {
+		var oldestID string
+
+		for id, v := range responseStore {
+			if time.Since(v.created) > responseStoreTTL {
+				delete(responseStore, id)
+			} else if oldestID == "" || v.created.Before(responseStore[oldestID].created) {
+				oldestID = id
+			}
+		}
+
+		if len(responseStore) >= responseStoreSize {
+			delete(responseStore, oldestID)
+		}
+	}
+
+	responseStore[stored.response.ID] = stored
+}
+
+// responseInputToMessages converts Responses API input items into chat messages.
+func responseInputToMessages(input gjson.Result) ([]any, error) {
+	if input.Type == gjson.String {
+		return []any{map[string]any{"role": "user", "content": input.String()}}, nil
+	}
+
+	if !input.IsArray() {
+		return nil, errors.New("input must be a string or an array of items")
+	}
+
+	var messages []any
+
+	for _, item := range input.Array() {
+		switch item.Get("type").String() {
+		case "", "message":
+			role := item.Get("role").String()
+			if role == "developer" {
+				role = "system"
+			}
+
+			messages = append(messages, map[string]any{"role": role, "content": responseContentToChat(item.Get("content"))})
+		case "function_call":
+			messages = append(messages, map[string]any{
+				"role":    "assistant",
+				"content": nil,
+				"tool_calls": []any{map[string]any{
+					"id":   item.Get("call_id").String(),
+					"type": "function",
+					"function": map[string]string{
+						"name":      item.Get("name").String(),
+						"arguments": item.Get("arguments").String(),
+					},
+				}},
+			})
+		case "function_call_output":
+			messages = append(messages, map[string]any{
+				"role":         "tool",
+				"tool_call_id": item.Get("call_id").String(),
+				"content":      item.Get("output").String(),
+			})
+		default:
+			return nil, fmt.Errorf("unsupported input item type %q", item.Get("type").String())
+		}
+	}
+
+	return messages, nil
+}
+
+// responseContentToChat returns plain text for text-only content and chat content parts otherwise.
+func responseContentToChat(content gjson.Result) any {
+	if !content.IsArray() {
+		return content.String()
+	}
+
+	var (
+		parts []any
+		texts []string
+	)
+
+	for _, part := range content.Array() {
+		switch part.Get("type").String() {
+		case "input_text", "output_text", "text":
+			texts = append(texts, part.Get("text").String())
+			parts = append(parts, map[string]any{"type": "text", "text": part.Get("text").String()})
+		case "input_image":
+			parts = append(parts, map[string]any{"type": "image_url", "image_url": map[string]string{"url": part.Get("image_url").String()}})
+		}
+	}
+
+	if len(texts) == len(parts) {
+		return strings.Join(texts, "\n")
+	}
+
+	return parts
+}
+
+// responseRequestToChat builds the chat completions body for a Responses API request.
+func responseRequestToChat(request gjson.Result, messages []any) ([]byte, error) {
+	if instructions := request.Get("instructions").String(); instructions != "" {
+		messages = append([]any{map[string]any{"role": "system", "content": instructions}}, messages...)
+	}
+
+	body := map[string]any{
+		"model":    request.Get("model").String(),
+		"messages": messages,
+	}
+
+	if v := request.Get("max_output_tokens"); v.Exists() {
+		body["max_tokens"] = v.Int()
+	}
+
+	for _, field := range []string{"temperature", "top_p"} {
+		if v := request.Get(field); v.Exists() {
+			body[field] = v.Value()
+		}
+	}
+
+	var tools []any
+
+	for _, tool := range request.Get("tools").Array() {
+		if tool.Get("type").String() != "function" {
+			return nil, fmt.Errorf("unsupported tool type %q", tool.Get("type").String())
+		}
+
+		tools = append(tools, map[string]any{
+			"type": "function",
+			"function": map[string]any{
+				"name":        tool.Get("name").String(),
+				"description": tool.Get("description").String(),
+				"parameters":  tool.Get("parameters").Value(),
+			},
+		})
+	}
+
+	if tools != nil {
+		body["tools"] = tools
+	}
+
+	if toolChoice := request.Get("tool_choice"); toolChoice.IsObject() {
+		body["tool_choice"] = map[string]any{"type": "function", "function": map[string]string{"name": toolChoice.Get("name").String()}}
+	} else if toolChoice.Exists() {
+		body["tool_choice"] = toolChoice.String()
+	}
+
+	switch format := request.Get("text.format"); format.Get("type").String() {
+	case "json_schema":
+		body["response_format"] = map[string]any{
+			"type": "json_schema",
+			"json_schema": map[string]any{
+				"name":   format.Get("name").String(),
+				"schema": format.Get("schema").Value(),
+				"strict": format.Get("strict").Bool(),
+			},
+		}
+	case "json_object":
+		body["response_format"] = map[string]string{"type": "json_object"}
+	}
+
+	return json.Marshal(body)
+}
+
+// chatToResponse converts a chat completion into a Responses API object and
+// returns the assistant message to keep in the conversation history.
+func chatToResponse(chatResponse []byte) (Response, any) {
+	message := gjson.GetBytes(chatResponse, "choices.0.message")
+
+	response := Response{
+		ID:        "resp_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		Object:    "response",
+		CreatedAt: time.Now().Unix(),
+		Status:    "completed",
+		Model:     gjson.GetBytes(chatResponse, "model").String(),
+		Output:    []ResponseOutput{},
+		Usage: &ResponseUsage{
+			InputTokens:  int(gjson.GetBytes(chatResponse, "usage.prompt_tokens").Int()),
+			OutputTokens: int(gjson.GetBytes(chatResponse, "usage.completion_tokens").Int()),
+			TotalTokens:  int(gjson.GetBytes(chatResponse, "usage.total_tokens").Int()),
+		},
+	}
+
+	if content := message.Get("content").String(); content != "" {
+		response.Output = append(response.Output, ResponseOutput{
+			Type:    "message",
+			ID:      "msg_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+			Status:  "completed",
+			Role:    "assistant",
+			Content: []ResponseContentPart{{Type: "output_text", Text: content, Annotations: []any{}}},
+		})
+	}
+
+	for _, call := range message.Get("tool_calls").Array() {
+		response.Output = append(response.Output, ResponseOutput{
+			Type:      "function_call",
+			ID:        "fc_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+			Status:    "completed",
+			CallID:    call.Get("id").String(),
+			Name:      call.Get("function.name").String(),
+			Arguments: call.Get("function.arguments").String(),
+		})
+	}
+
+	return response, message.Value()
+}
+
+// writeResponseStream sends the finished response as Responses API streaming events.
+func writeResponseStream(w http.ResponseWriter, response Response) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	var sequence int
+
+	send := func(event string, data map[string]any) {
+		data["type"] = event
+		data["sequence_number"] = sequence
+		sequence++
+
+		fmt.Fprintf(w, "event: %s\n", event)
+		writeSSE(w, data)
+	}
+
+	inProgress := response
+	inProgress.Status = "in_progress"
+	inProgress.Output = []ResponseOutput{}
+	inProgress.Usage = nil
+
+	send("response.created", map[string]any{"response": inProgress})
+
+	for i, item := range response.Output {
+		added := item
+		added.Status = "in_progress"
+		added.Content = []ResponseContentPart{}
+
+		send("response.output_item.added", map[string]any{"output_index": i, "item": added})
+
+		for j, part := range item.Content {
+			ids := map[string]any{"item_id": item.ID, "output_index": i, "content_index": j}
+
+			send("response.content_part.added", withFields(ids, "part", ResponseContentPart{Type: part.Type, Annotations: []any{}}))
+			send("response.output_text.delta", withFields(ids, "delta", part.Text))
+			send("response.output_text.done", withFields(ids, "text", part.Text))
+			send("response.content_part.done", withFields(ids, "part", part))
+		}
+
+		send("response.output_item.done", map[string]any{"output_index": i, "item": item})
+	}
+
+	send("response.completed", map[string]any{"response": response})
+}
+
+func withFields(fields map[string]any, key string, value any) map[string]any {
+	res := maps.Clone(fields)
+	res[key] = value
+
+	return res
+}
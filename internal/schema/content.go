@@ -0,0 +1,174 @@
+package schema
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"ai-proxy/internal/httpclient"
+)
+
+// AttachmentLength is the request length counted for an image or audio part,
+// close to the number of tokens providers bill for a picture.
+const AttachmentLength = 1000
+
+// maxAttachmentSize limits remote files downloaded for providers that need inline data.
+const maxAttachmentSize = 20 << 20
+
+// Content is a message content: a plain string or an array of content parts.
+type Content struct {
+	Text  string
+	Parts []ContentPart // nil for a plain string
+}
+
+type ContentPart struct {
+	Type       string      `json:"type"` // text, image_url or input_audio
+	Text       string      `json:"text,omitempty"`
+	ImageURL   *ImageURL   `json:"image_url,omitempty"`
+	InputAudio *InputAudio `json:"input_audio,omitempty"`
+}
+
+type ImageURL struct {
+	URL    string `json:"url"` // remote URL or data URI
+	Detail string `json:"detail,omitempty"`
+}
+
+type InputAudio struct {
+	Data   string `json:"data"`   // base64
+	Format string `json:"format"` // wav or mp3
+}
+
+func (c *Content) UnmarshalJSON(data []byte) error {
+	*c = Content{}
+
+	switch {
+	case string(data) == "null":
+		return nil
+	case len(data) > 0 && data[0] == '[':
+		return json.Unmarshal(data, &c.Parts)
+	default:
+		return json.Unmarshal(data, &c.Text)
+	}
+}
+
+func (c Content) MarshalJSON() ([]byte, error) {
+	if c.Parts != nil {
+		return json.Marshal(c.Parts)
+	}
+
+	return json.Marshal(c.Text)
+}
+
+// String returns the text of the content, joining the text parts with newlines.
+func (c Content) String() string {
+	if c.Parts == nil {
+		return c.Text
+	}
+
+	var texts []string
+
+	for _, part := range c.Parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+
+	return strings.Join(texts, "\n")
+}
+
+// Length returns the length of the text plus AttachmentLength for every attachment.
+func (c Content) Length() int {
+	length := len(c.String())
+
+	for _, part := range c.Parts {
+		if part.Type != "text" {
+			length += AttachmentLength
+		}
+	}
+
+	return length
+}
+
+// Data returns the MIME type and the bytes of an image or audio part, decoding
+// data URIs and downloading remote images within ctx.
+func (p ContentPart) Data(ctx context.Context) (string, []byte, error) {
+	switch {
+	case p.Type == "input_audio" && p.InputAudio != nil:
+		data, err := base64.StdEncoding.DecodeString(p.InputAudio.Data)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid input_audio data: %w", err)
+		}
+
+		return "audio/" + strings.Replace(p.InputAudio.Format, "mp3", "mpeg", 1), data, nil
+	case p.Type == "image_url" && p.ImageURL != nil:
+		if strings.HasPrefix(p.ImageURL.URL, "data:") {
+			return ParseDataURI(p.ImageURL.URL)
+		}
+
+		return download(ctx, p.ImageURL.URL)
+	default:
+		return "", nil, fmt.Errorf("content part %q has no data", p.Type)
+	}
+}
+
+// ParseDataURI decodes a base64 data URI like data:image/png;base64,....
+func ParseDataURI(uri string) (string, []byte, error) {
+	header, payload, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok || !strings.HasSuffix(header, ";base64") {
+		return "", nil, errors.New("only base64 data URIs are supported")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid data URI: %w", err)
+	}
+
+	return strings.TrimSuffix(header, ";base64"), data, nil
+}
+
+// download fetches a remote file given by the user with the client for public
+// URLs, which sends no provider headers and refuses internal addresses. The
+// client has no overall timeout, so ctx must carry the deadline of the call.
+func download(ctx context.Context, url string) (string, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	resp, err := httpclient.Public.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("unexpected status code: %d for %s", resp.StatusCode, url)
+	}
+
+	if resp.ContentLength > maxAttachmentSize {
+		return "", nil, fmt.Errorf("file %s is larger than %d bytes", url, maxAttachmentSize)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAttachmentSize+1))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(data) > maxAttachmentSize {
+		return "", nil, fmt.Errorf("file %s is larger than %d bytes", url, maxAttachmentSize)
+	}
+
+	mimeType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mimeType == "application/octet-stream" {
+		mimeType = http.DetectContentType(data)
+	}
+
+	return mimeType, data, nil
+}
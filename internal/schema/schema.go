@@ -1,11 +1,14 @@
 package schema
 
 type RequestOpenAICompatable struct {
-	Messages []struct {
-		Role    string `json:"role"`
-		Content string `json:"content"`
-	} `json:"messages,omitempty"`
-	Model string `json:"model,omitempty"`
+	Messages []Message `json:"messages,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	N        int       `json:"n,omitempty"`
+}
+
+type Message struct {
+	Role    string  `json:"role"`
+	Content Content `json:"content"`
 }
 
 type ResponseOpenAICompatable struct {
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"ai-proxy/internal/cloudflare"
+	"ai-proxy/internal/gigachat"
+	"ai-proxy/internal/openai"
+)
+
+// Пример запроса
+// curl http://127.0.0.1:8080/v1/audio/speech -d '{"model": "tts-1", "input": "Привет!", "voice": "alloy"}' -o speech.mp3
+
+type RequestSpeech struct {
+	Model          string  `json:"model,omitempty"`
+	Input          string  `json:"input"`
+	Voice          string  `json:"voice,omitempty"`
+	ResponseFormat string  `json:"response_format,omitempty"`
+	Speed          float64 `json:"speed,omitempty"`
+}
+
+type speechResponse struct {
+	Body        io.ReadCloser
+	ContentType string
+}
+
+var speechContentTypes = map[string]string{
+	"mp3":  "audio/mpeg",
+	"opus": "audio/ogg",
+	"aac":  "audio/aac",
+	"flac": "audio/flac",
+	"wav":  "audio/wav",
+	"pcm":  "audio/pcm",
+}
+
+// HandlerSpeech implements the OpenAI compatible /audio/speech endpoint.
+func HandlerSpeech(w http.ResponseWriter, req *http.Request) {
+	var requestBody RequestSpeech
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	err := json.NewDecoder(req.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+
+		return
+	}
+
+	if requestBody.Input == "" {
+		http.Error(w, "Empty input", http.StatusBadRequest)
+
+		return
+	}
+
+	requestBody.ResponseFormat = cmp.Or(requestBody.ResponseFormat, "mp3")
+
+	if _, ok := speechContentTypes[requestBody.ResponseFormat]; !ok {
+		http.Error(w, fmt.Sprintf("Unsupported response_format %q", requestBody.ResponseFormat), http.StatusBadRequest)
+
+		return
+	}
+
+	var response speechResponse
+
+	if isModelName(requestBody.Model, ModelTypeSpeech) {
+		response, err = synthesize(req.Context(), requestBody.Model, requestBody)
+	} else {
+		response, err = callWithFailover(func(model Model) bool {
+			return model.Type == ModelTypeSpeech &&
+				supportsSpeechFormat(model, requestBody.ResponseFormat) &&
+				fitsRequestLength(model, len(requestBody.Input))
+		}, func(modelName string) (speechResponse, error) {
+			return synthesize(req.Context(), modelName, requestBody)
+		})
+	}
+
+	if errors.Is(err, errNoModels) {
+		http.Error(w, "No available speech models for this request", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	if err != nil {
+		log.Printf("ERROR: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	defer response.Body.Close()
+
+	w.Header().Set("Content-Type", response.ContentType)
+
+	n, err := io.Copy(w, response.Body)
+	if err != nil {
+		log.Printf("Error streaming speech: %v", err)
+
+		return
+	}
+
+	log.Printf("Get speech in %d bytes\n", n)
+}
+
+func supportsSpeechFormat(model Model, format string) bool {
+	switch model.Provider {
+	case "cloudflare":
+		return format == "mp3"
+	case "salute":
+		_, ok := gigachat.SaluteFormat(format)
+
+		return ok
+	default:
+		return true
+	}
+}
+
+func synthesize(ctx context.Context, modelName string, requestBody RequestSpeech) (speechResponse, error) {
+	model, found := getModelByName(modelName)
+	if !found {
+		return speechResponse{}, fmt.Errorf("Specified model not found - %s", modelName)
+	}
+
+	log.Printf("Request to speech model: %s - %s\n", modelName, printFirstChars(requestBody.Input))
+
+	if !supportsSpeechFormat(model, requestBody.ResponseFormat) {
+		return speechResponse{}, fmt.Errorf("model %s does not support response_format %q", modelName, requestBody.ResponseFormat)
+	}
+
+	contentType := speechContentTypes[requestBody.ResponseFormat]
+
+	release, err := acquireModel(ctx, model)
+	if err != nil {
+		return speechResponse{}, err
+	}
+
+	// the audio is streamed to the client, so the timeout ends with the response headers
+	ctx, stop := streamContext(ctx, model)
+	defer stop()
+
+	switch model.Provider {
+	case "cloudflare":
+		// MeloTTS takes a language instead of a voice
+		lang := "en"
+		if len(requestBody.Voice) == 2 {
+			lang = strings.ToLower(requestBody.Voice)
+		}
+
+		audio, err := callWithToken(model, func(token string) ([]byte, error) {
+			return cloudflare.Speak(ctx, model.URL, token, requestBody.Input, lang)
+		})
+
+		release()
+
+		if err != nil {
+			return speechResponse{}, err
+		}
+
+		return speechResponse{Body: io.NopCloser(bytes.NewReader(audio)), ContentType: contentType}, nil
+	case "salute":
+		resp, err := callWithToken(model, func(token string) (*http.Response, error) {
+			return gigachat.Synthesize(ctx, model.URL, token, requestBody.Input, requestBody.Voice, requestBody.ResponseFormat)
+		})
+		if err != nil {
+			release()
+
+			return speechResponse{}, err
+		}
+
+		return speechResponse{Body: releaseOnClose{ReadCloser: resp.Body, release: release}, ContentType: cmp.Or(resp.Header.Get("Content-Type"), contentType)}, nil
+	default:
+		reqBody, err := json.Marshal(requestBody)
+		if err != nil {
+			release()
+
+			return speechResponse{}, err
+		}
+
+		resp, err := callWithToken(model, func(token string) (*http.Response, error) {
+			return openai.Stream(ctx, model.URL, strings.TrimPrefix(model.Name, model.Provider+"/"), token, reqBody)
+		})
+		if err != nil {
+			release()
+
+			return speechResponse{}, err
+		}
+
+		return speechResponse{Body: releaseOnClose{ReadCloser: resp.Body, release: release}, ContentType: cmp.Or(resp.Header.Get("Content-Type"), contentType)}, nil
+	}
+}
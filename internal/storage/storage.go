@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrNotFound = errors.New("file not found")
+
+type Config struct {
+	Type      string        `yaml:"type"` // local or s3, empty disables storage
+	Dir       string        `yaml:"dir"`
+	PublicURL string        `yaml:"public_url"` // base URL of the proxy used in returned links
+	Retention time.Duration `yaml:"retention"`  // 0 keeps files forever
+	S3        S3Config      `yaml:"s3"`
+}
+
+type Object struct {
+	ID       string
+	Modified time.Time
+}
+
+// Store keeps generated files addressed by their ID.
+type Store interface {
+	Put(id string, data []byte) error
+	Get(id string) ([]byte, error)
+	Delete(id string) error
+	List() ([]Object, error)
+}
+
+func New(cfg Config) (Store, error) {
+	switch cfg.Type {
+	case "local":
+		return NewLocal(cfg.Dir)
+	case "s3":
+		return NewS3(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+	}
+}
+
+// Expire deletes the objects accepted by ours that are older than retention and
+// returns how many were removed; other objects sharing the bucket are left alone.
+func Expire(store Store, retention time.Duration, ours func(id string) bool) (int, error) {
+	objects, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int
+
+	deadline := time.Now().Add(-retention)
+
+	for _, object := range objects {
+		if object.Modified.After(deadline) || !ours(object.ID) {
+			continue
+		}
+
+		err = store.Delete(object.ID)
+		if err != nil {
+			return removed, err
+		}
+
+		removed++
+	}
+
+	return removed, nil
+}
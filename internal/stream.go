@@ -0,0 +1,341 @@
+package internal
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"ai-proxy/internal/openai"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const maxStreamLineSize = 4 << 20
+
+type chatStream struct {
+	model    Model
+	upstream *http.Response // SSE stream of an OpenAI compatible provider
+	response []byte         // complete answer of a provider that cannot stream
+}
+
+// Close releases the upstream stream of a request that lost a hedged race.
+func (s chatStream) Close() error {
+	if s.upstream == nil {
+		return nil
+	}
+
+	return s.upstream.Body.Close()
+}
+
+// streamChat answers a stream=true chat request with server-sent events. OpenAI
+// compatible providers are streamed through, others are replayed from the full answer.
+func streamChat(ctx context.Context, w http.ResponseWriter, reqBodyBytes []byte, opts chatOptions) {
+	// several choices may come from several calls, so they are collected first
+	if gjson.GetBytes(reqBodyBytes, "n").Int() > 1 {
+		response, err := completeChat(ctx, reqBodyBytes, opts)
+		if err != nil {
+			writeChatError(w, err)
+
+			return
+		}
+
+		opts.context.writeHeaders(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		writeChatStream(w, response)
+
+		return
+	}
+
+	stream, err := routeStream(ctx, reqBodyBytes, opts)
+	if err != nil {
+		writeChatError(w, err)
+
+		return
+	}
+
+	opts.context.writeHeaders(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if stream.upstream == nil {
+		writeChatStream(w, stream.response)
+
+		return
+	}
+
+	defer stream.upstream.Body.Close()
+
+	forwardChatStream(stream.upstream.Body, stream.model, opts, func(chunk []byte) bool {
+		writeSSEData(w, chunk)
+
+		return true
+	})
+	writeSSEDone(w)
+}
+
+// routeStream opens a chat stream on a model chosen like for other chat requests.
+func routeStream(ctx context.Context, reqBodyBytes []byte, opts chatOptions) (chatStream, error) {
+	return routeModel(ctx, reqBodyBytes, nil, opts, func(ctx context.Context, modelName string, body []byte) (chatStream, error) {
+		return openChatStream(ctx, modelName, body, opts)
+	})
+}
+
+func openChatStream(ctx context.Context, modelName string, reqBodyBytes []byte, opts chatOptions) (chatStream, error) {
+	model, found := findModel(modelName)
+	if !found || model.Disabled {
+		return chatStream{}, fmt.Errorf("Specified model not found - %s", modelName)
+	}
+
+	if !isOpenAICompatible(model) {
+		body, err := sjson.SetBytes(reqBodyBytes, "stream", false)
+		if err != nil {
+			return chatStream{}, err
+		}
+
+		resp, err := sendRequestToLLM(ctx, modelName, body, opts)
+
+		return chatStream{model: model, response: resp}, err
+	}
+
+	model = pickToken(model)
+
+	release, err := acquireModel(ctx, model)
+	if err != nil {
+		return chatStream{}, err
+	}
+
+	ctx, stop := streamContext(ctx, model)
+	defer stop()
+
+	log.Printf("Request to model (stream): %s - %s\n", modelName, printFirstChars(messageText(gjson.GetBytes(reqBodyBytes, "messages.0.content"))))
+
+	resp, err := callWithToken(model, func(token string) (*http.Response, error) {
+		return openai.Stream(ctx, model.URL, providerModelName(model), token, reqBodyBytes)
+	})
+
+	if err != nil {
+		release()
+
+		return chatStream{}, err
+	}
+
+	// the limiters are freed when the stream is read to the end or dropped
+	resp.Body = releaseOnClose{ReadCloser: resp.Body, release: release}
+
+	return chatStream{model: model, upstream: resp}, nil
+}
+
+// forwardChatStream passes the chat completion chunks of body to write, applying
+// the reasoning mode of the model to the deltas of every choice, until the stream
+// ends or write returns false.
+func forwardChatStream(body io.Reader, model Model, opts chatOptions, write func(chunk []byte) bool) {
+	var (
+		content strings.Builder
+		last    []byte
+	)
+
+	mode := reasoningMode(model, opts)
+	parsers := make(map[int64]*thinkParser)
+	// text of a model that omits <think> is reasoning only if </think> follows, so it is held until a tag shows
+	held := model.OmitsThinkTag
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxStreamLineSize)
+
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue // comments and keep-alives
+		}
+
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		chunk := []byte(data)
+
+		if mode != ReasoningKeep {
+			var err error
+
+			chunk, err = processReasoningChunk(chunk, mode, held, parsers)
+			if err != nil {
+				log.Printf("Error processing stream chunk: %v", err)
+
+				continue
+			}
+		}
+
+		content.WriteString(gjson.GetBytes(chunk, "choices.0.delta.content").String())
+		last = chunk
+
+		if !write(chunk) {
+			return
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		log.Printf("Error reading stream: %v", err)
+	}
+
+	// the stream ended without a finish_reason for some choices
+	for _, index := range slices.Sorted(maps.Keys(parsers)) {
+		chunk, err := flushReasoningChunk(last, index, mode, parsers[index])
+		if err != nil {
+			log.Printf("Error processing stream chunk: %v", err)
+
+			continue
+		}
+
+		if chunk == nil {
+			continue
+		}
+
+		if index == 0 {
+			content.WriteString(gjson.GetBytes(chunk, "choices.0.delta.content").String())
+		}
+
+		if !write(chunk) {
+			return
+		}
+	}
+
+	log.Printf("Response (stream): %s\n", printFirstChars(content.String()))
+}
+
+// processReasoningChunk separates <think> blocks in the deltas of a chunk, keeping
+// the parser state of every choice between chunks.
+func processReasoningChunk(chunk []byte, mode string, held bool, parsers map[int64]*thinkParser) ([]byte, error) {
+	var err error
+
+	for i, choice := range gjson.GetBytes(chunk, "choices").Array() {
+		index := choice.Get("index").Int()
+
+		parser, ok := parsers[index]
+		if !ok {
+			parser = &thinkParser{undecided: held}
+			parsers[index] = parser
+		}
+
+		delta := choice.Get("delta")
+
+		// the provider returns the reasoning separately, no </think> will come in the content
+		providerReasoning := delta.Get("reasoning_content").String() + delta.Get("reasoning").String()
+		if providerReasoning != "" {
+			parser.undecided = false
+		}
+
+		content, reasoning := parser.Feed(delta.Get("content").String())
+		reasoning = providerReasoning + reasoning
+
+		if choice.Get("finish_reason").String() != "" {
+			restContent, restReasoning := parser.Flush()
+			content += restContent
+			reasoning += restReasoning
+		}
+
+		if !delta.Get("content").Exists() && content == "" && reasoning == "" {
+			continue
+		}
+
+		chunk, err = setReasoning(chunk, fmt.Sprintf("choices.%d.delta", i), "content", content, reasoning, mode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return chunk, nil
+}
+
+// flushReasoningChunk returns a chunk with the text the parser of a choice still
+// holds, or nil if there is none.
+func flushReasoningChunk(last []byte, index int64, mode string, parser *thinkParser) ([]byte, error) {
+	content, reasoning := parser.Flush()
+	if content == "" && (reasoning == "" || mode != ReasoningSeparate) {
+		return nil, nil
+	}
+
+	chunk, err := json.Marshal(map[string]any{
+		"id":      gjson.GetBytes(last, "id").String(),
+		"object":  "chat.completion.chunk",
+		"created": gjson.GetBytes(last, "created").Int(),
+		"model":   gjson.GetBytes(last, "model").String(),
+		"choices": []any{map[string]any{"index": index, "delta": map[string]any{}, "finish_reason": nil}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error in json.Marshal: %w", err)
+	}
+
+	return setReasoning(chunk, "choices.0.delta", "content", content, reasoning, mode)
+}
+
+// writeChatStream replays a complete chat completion as a stream of chunks.
+func writeChatStream(w http.ResponseWriter, resp []byte) {
+	response := gjson.ParseBytes(resp)
+
+	chunk := map[string]any{
+		"id":      response.Get("id").String(),
+		"object":  "chat.completion.chunk",
+		"created": cmp.Or(response.Get("created").Int(), time.Now().Unix()),
+		"model":   response.Get("model").String(),
+	}
+
+	for _, choice := range response.Get("choices").Array() {
+		delta, _ := choice.Get("message").Value().(map[string]any)
+
+		if toolCalls, ok := delta["tool_calls"].([]any); ok {
+			for i, call := range toolCalls {
+				if call, ok := call.(map[string]any); ok {
+					call["index"] = i
+				}
+			}
+		}
+
+		chunk["choices"] = []any{map[string]any{"index": choice.Get("index").Int(), "delta": delta, "finish_reason": nil}}
+		writeSSE(w, chunk)
+
+		chunk["choices"] = []any{map[string]any{"index": choice.Get("index").Int(), "delta": map[string]any{}, "finish_reason": choice.Get("finish_reason").String()}}
+		writeSSE(w, chunk)
+	}
+
+	writeSSEDone(w)
+}
+
+func writeSSE(w http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error marshal event: %v", err)
+
+		return
+	}
+
+	writeSSEData(w, data)
+}
+
+func writeSSEData(w http.ResponseWriter, data []byte) {
+	fmt.Fprintf(w, "data: %s\n\n", data)
+
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func writeSSEDone(w http.ResponseWriter) {
+	fmt.Fprint(w, "data: [DONE]\n\n")
+
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
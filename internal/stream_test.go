@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestProcessReasoningChunkProviderReasoning(t *testing.T) {
+	parsers := make(map[int64]*thinkParser)
+
+	chunk, err := processReasoningChunk([]byte(`{"choices":[{"index":0,"delta":{"content":"Hel"}}]}`), ReasoningSeparate, true, parsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content := gjson.GetBytes(chunk, "choices.0.delta.content").String(); content != "" {
+		t.Fatalf("held content %q was sent", content)
+	}
+
+	// a separate reasoning field means no </think> is coming, the held text is content
+	chunk, err = processReasoningChunk([]byte(`{"choices":[{"index":0,"delta":{"content":"lo","reasoning_content":"r"}}]}`), ReasoningSeparate, true, parsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content := gjson.GetBytes(chunk, "choices.0.delta.content").String(); content != "Hello" {
+		t.Errorf("content %q, want Hello", content)
+	}
+
+	if reasoning := gjson.GetBytes(chunk, "choices.0.delta.reasoning_content").String(); reasoning != "r" {
+		t.Errorf("reasoning_content %q, want r", reasoning)
+	}
+}
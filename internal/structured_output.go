@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"ai-proxy/internal/jsonschema"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+type StructuredOutputConfig struct {
+	MaxAttempts int    `yaml:"max_attempts"` // 0 disables validation of response_format
+	Retry       string `yaml:"retry"`        // same (default), next or none
+}
+
+var (
+	StructuredOutput StructuredOutputConfig
+
+	errStructuredOutput = errors.New("structured output validation failed")
+)
+
+// getOutputSchema returns the schema the answer must follow for json_schema and json_object response formats.
+func getOutputSchema(reqBodyBytes []byte) (any, bool) {
+	format := gjson.GetBytes(reqBodyBytes, "response_format")
+
+	switch format.Get("type").String() {
+	case "json_schema":
+		return format.Get("json_schema.schema").Value(), true
+	case "json_object":
+		return map[string]any{"type": "object"}, true
+	default:
+		return nil, false
+	}
+}
+
+// completeStructured validates answers against the requested schema and asks the
+// same or the next model to repair an invalid answer, up to StructuredOutput.MaxAttempts times.
+func completeStructured(ctx context.Context, reqBodyBytes []byte, schema any, opts chatOptions) ([]byte, error) {
+	var (
+		tried     []string
+		modelName string
+		lastErr   error
+		response  []byte
+		err       error
+	)
+
+	body := reqBodyBytes
+
+	for attempt := range StructuredOutput.MaxAttempts {
+		if attempt > 0 && StructuredOutput.Retry != "next" {
+			response, modelName, err = sendRepair(ctx, modelName, body, tried, opts)
+		} else {
+			response, modelName, err = routeChat(ctx, body, tried, opts)
+		}
+
+		if err != nil {
+			if lastErr != nil && errors.Is(err, errNoModels) {
+				break
+			}
+
+			return nil, err
+		}
+
+		tried = append(tried, modelName)
+
+		var invalid string
+
+		response, invalid, err = validateStructuredOutput(response, schema)
+		if err == nil {
+			return response, nil
+		}
+
+		lastErr = err
+		log.Printf("Invalid structured output from %s (attempt %d): %v", modelName, attempt+1, err)
+
+		if StructuredOutput.Retry == "none" {
+			break
+		}
+
+		body, err = addRepairPrompt(body, invalid, lastErr, schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("%w after %d attempts: %w", errStructuredOutput, len(tried), lastErr)
+}
+
+// sendRepair asks the model that gave the invalid answer to fix it, when its
+// quota, priority budget and circuits allow another request. Otherwise, or when
+// the model fails rather than answers wrong, the repair goes to the next model.
+func sendRepair(ctx context.Context, modelName string, body []byte, tried []string, opts chatOptions) ([]byte, string, error) {
+	same := nextModel(func(model Model) bool {
+		return model.Name == modelName && withinBudget(model, opts.priority)
+	})
+
+	if same != "" {
+		response, err := sendRequestToLLM(ctx, modelName, body, opts)
+		reportResult(modelName, err)
+
+		if err == nil || errors.Is(err, context.Canceled) {
+			return response, modelName, err
+		}
+
+		log.Printf("Error sending repair request to %s: %v", modelName, err)
+	}
+
+	return routeChat(ctx, body, tried, opts)
+}
+
+// validateStructuredOutput checks every choice and replaces its content with the
+// bare JSON when the model wrapped it in a markdown code block.
+func validateStructuredOutput(response []byte, schema any) ([]byte, string, error) {
+	var err error
+
+	for i, choice := range gjson.GetBytes(response, "choices").Array() {
+		content := choice.Get("message.content").String()
+		cleaned := stripCodeFence(content)
+
+		validationErr := jsonschema.ValidateJSON(schema, []byte(cleaned))
+		if validationErr != nil {
+			return response, content, validationErr
+		}
+
+		if cleaned != content {
+			response, err = sjson.SetBytes(response, fmt.Sprintf("choices.%d.message.content", i), cleaned)
+			if err != nil {
+				return nil, content, fmt.Errorf("error sjson.SetBytes in structured output: %w", err)
+			}
+		}
+	}
+
+	return response, "", nil
+}
+
+func stripCodeFence(content string) string {
+	content = strings.TrimSpace(content)
+
+	if !strings.HasPrefix(content, "```") {
+		return content
+	}
+
+	content = strings.TrimPrefix(content, "```")
+	// skip the language tag
+	if i := strings.IndexByte(content, '\n'); i != -1 {
+		content = content[i+1:]
+	}
+
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(content), "```"))
+}
+
+// addRepairPrompt appends the invalid answer and a request to fix it to the conversation.
+func addRepairPrompt(reqBodyBytes []byte, invalid string, validationErr error, schema any) ([]byte, error) {
+	schemaJSON, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := sjson.SetBytes(reqBodyBytes, "messages.-1", map[string]string{"role": "assistant", "content": invalid})
+	if err != nil {
+		return nil, err
+	}
+
+	return sjson.SetBytes(body, "messages.-1", map[string]string{
+		"role": "user",
+		"content": fmt.Sprintf("Your previous answer is not valid JSON for the required schema: %v. "+
+			"Answer again with only a JSON value matching this JSON schema, without any other text:\n%s", validationErr, schemaJSON),
+	})
+}
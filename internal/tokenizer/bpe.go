@@ -0,0 +1,48 @@
+package tokenizer
+
+import (
+	"math"
+	"slices"
+)
+
+// maxPieceSize splits very long pieces (base64, long runs of symbols) to keep merging fast.
+const maxPieceSize = 4096
+
+func (e *Encoding) countPiece(piece string) int {
+	if _, ok := e.ranks[piece]; ok {
+		return 1
+	}
+
+	if len(piece) > maxPieceSize {
+		return e.countPiece(piece[:maxPieceSize]) + e.countPiece(piece[maxPieceSize:])
+	}
+
+	return e.merge(piece)
+}
+
+// merge applies byte pair merges in rank order, like tiktoken, and returns the number of tokens.
+func (e *Encoding) merge(piece string) int {
+	// boundaries of the current tokens
+	parts := make([]int, len(piece)+1)
+	for i := range parts {
+		parts[i] = i
+	}
+
+	for len(parts) > 2 {
+		best, bestRank := -1, math.MaxInt
+
+		for i := 0; i+2 < len(parts); i++ {
+			if rank, ok := e.ranks[piece[parts[i]:parts[i+2]]]; ok && rank < bestRank {
+				best, bestRank = i, rank
+			}
+		}
+
+		if best == -1 {
+			break
+		}
+
+		parts = slices.Delete(parts, best+1, best+2)
+	}
+
+	return len(parts) - 1
+}
@@ -0,0 +1,102 @@
+package tokenizer
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name  string
+		ranks map[string]int
+		piece string
+		want  int
+	}{
+		{"no merges", map[string]int{}, "abc", 3},
+		{"lowest rank first", map[string]int{"ab": 0, "bc": 1, "abc": 2}, "abc", 1},
+		{"rank order decides", map[string]int{"bc": 0, "ab": 1}, "abc", 2},
+		{"repeated pairs", map[string]int{"ab": 0, "abab": 1}, "ababab", 2},
+		{"multibyte runes", map[string]int{"\xd0\x9f": 0}, "П", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Encoding{ranks: tt.ranks, pattern: cl100kSplitter}
+
+			if got := e.merge(tt.piece); got != tt.want {
+				t.Errorf("merge(%q) = %d, want %d", tt.piece, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountPieceLong(t *testing.T) {
+	e := &Encoding{ranks: map[string]int{"aa": 0}, pattern: cl100kSplitter}
+
+	// split at maxPieceSize, both halves are even
+	if got := e.countPiece(strings.Repeat("a", 2*maxPieceSize)); got != maxPieceSize {
+		t.Errorf("countPiece = %d, want %d", got, maxPieceSize)
+	}
+}
+
+// TestCountTestVocabulary runs a whole count, from parsing the tiktoken file to
+// splitting and merging, on the small vocabulary in testdata: the 256 bytes and
+// a few merges, so that the counts can be worked out by hand.
+func TestCountTestVocabulary(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.tiktoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranks, err := parseRanks(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Encoding{name: "test", ranks: ranks, pattern: cl100kSplitter}
+
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"hello world", 2},    // hello, " world"
+		{"Hello, world!", 7},  // H e ll o , " world" !
+		{"hi hello", 4},       // h i " " hello
+		{"мими", 2},           // ми ми, merged from bytes
+		{"12345", 3},          // 123 4 5, digits split in threes
+		{"hello\n\nworld", 6}, // hello \n \n w or ld
+	}
+
+	for _, tt := range tests {
+		if got := e.Count(tt.text); got != tt.want {
+			t.Errorf("Count(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+// TestCountKnown checks counts reported by tiktoken; it needs the vocabularies in bpe or Dir.
+func TestCountKnown(t *testing.T) {
+	tests := []struct {
+		encoding string
+		text     string
+		want     int
+	}{
+		{CL100K, "hello world", 2},
+		{CL100K, "Hello, world!", 4},
+		{CL100K, "tiktoken is great!", 6},
+		{O200K, "hello world", 2},
+		{O200K, "Hello, world!", 4},
+	}
+
+	for _, tt := range tests {
+		encoding, err := Get(tt.encoding)
+		if err != nil {
+			t.Skipf("encoding %s is not available: %v", tt.encoding, err)
+		}
+
+		if got := encoding.Count(tt.text); got != tt.want {
+			t.Errorf("%s: Count(%q) = %d, want %d", tt.encoding, tt.text, got, tt.want)
+		}
+	}
+}
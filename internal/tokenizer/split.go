@@ -0,0 +1,71 @@
+package tokenizer
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Unicode whitespace, \s of RE2 covers only ASCII.
+const ws = `\t-\r \x{85}\p{Z}`
+
+// The tiktoken patterns without the \s+(?!\S) alternative, which RE2 cannot
+// express; split handles it by giving the last space of a run to the next word.
+var (
+	cl100kSplitter = newSplitter(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^` + ws + `\p{L}\p{N}]+[\r\n]*|[` + ws + `]*[\r\n]+|[` + ws + `]+`)
+	o200kSplitter  = newSplitter(`[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|\p{N}{1,3}| ?[^` + ws + `\p{L}\p{N}]+[\r\n/]*|[` + ws + `]*[\r\n]+|[` + ws + `]+`)
+)
+
+type splitter struct {
+	re *regexp.Regexp
+}
+
+func newSplitter(pattern string) *splitter {
+	return &splitter{re: regexp.MustCompile(`^(?:` + pattern + `)`)}
+}
+
+// split cuts text into the pieces that are encoded independently.
+func (s *splitter) split(text string) []string {
+	var pieces []string
+
+	for text != "" {
+		end := 0
+
+		if loc := s.re.FindStringIndex(text); loc != nil {
+			end = loc[1]
+		}
+
+		if end == 0 {
+			_, end = utf8.DecodeRuneInString(text)
+		}
+
+		if end < len(text) && isTrailingSpaces(text[:end]) {
+			_, size := utf8.DecodeLastRuneInString(text[:end])
+			end -= size
+		}
+
+		pieces = append(pieces, text[:end])
+		text = text[end:]
+	}
+
+	return pieces
+}
+
+// isTrailingSpaces reports whether a run of two or more spaces not ending with a
+// newline was matched, its last space belongs to the following word.
+func isTrailingSpaces(piece string) bool {
+	if utf8.RuneCountInString(piece) < 2 || strings.HasSuffix(piece, "\n") || strings.HasSuffix(piece, "\r") {
+		return false
+	}
+
+	for _, r := range piece {
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+
+	return true
+}
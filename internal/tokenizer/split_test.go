@@ -0,0 +1,37 @@
+package tokenizer
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name     string
+		splitter *splitter
+		text     string
+		want     []string
+	}{
+		{"words and punctuation", cl100kSplitter, "Hello, world!", []string{"Hello", ",", " world", "!"}},
+		{"contractions", cl100kSplitter, "I'm sure it's", []string{"I", "'m", " sure", " it", "'s"}},
+		{"uppercase contraction", cl100kSplitter, "DON'T", []string{"DON", "'T"}},
+		{"digits by three", cl100kSplitter, "1234567", []string{"123", "456", "7"}},
+		{"last space goes to the word", cl100kSplitter, "a   b", []string{"a", "  ", " b"}},
+		{"trailing spaces", cl100kSplitter, "a  ", []string{"a", "  "}},
+		{"newlines", cl100kSplitter, "a\n\n  b", []string{"a", "\n\n", " ", " b"}},
+		{"symbols with newline", cl100kSplitter, "x = {}\n", []string{"x", " =", " {}\n"}},
+		{"cyrillic", cl100kSplitter, "Привет, мир", []string{"Привет", ",", " мир"}},
+		{"o200k camel case", o200kSplitter, "HelloWorld", []string{"Hello", "World"}},
+		{"o200k contraction stays with the word", o200kSplitter, "I'm fine", []string{"I'm", " fine"}},
+		{"o200k slash after symbols", o200kSplitter, "a +/b", []string{"a", " +/", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.splitter.split(tt.text)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("split(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
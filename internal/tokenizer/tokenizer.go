@@ -0,0 +1,211 @@
+// Package tokenizer counts tokens with tiktoken compatible BPE encodings.
+// Encodings are read from the bpe directory bundled into the binary or from
+// Dir; without them the count falls back to Estimate.
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	CL100K   = "cl100k_base"
+	O200K    = "o200k_base"
+	Estimate = "estimate" // heuristic without a vocabulary
+)
+
+//go:embed bpe
+var bundled embed.FS
+
+// checksums are the SHA-256 of the published encodings, the Dockerfile pins the same ones.
+var checksums = map[string]string{
+	CL100K: "223921b76ee99bde995b7ff738513eef100fb51d18c93597a113bcffe865b2a7",
+	O200K:  "446a9538cb6c348e3516120d7c08b09f57c36495e2acfffe59a5bf8b0cfb1a2d",
+}
+
+type Config struct {
+	Dir string `yaml:"dir"` // optional directory with <encoding>.tiktoken files
+}
+
+// Dir is set from Config.Dir at startup.
+var Dir string
+
+type Encoding struct {
+	name    string
+	ranks   map[string]int
+	pattern *splitter
+}
+
+var (
+	encodings   = make(map[string]*Encoding)
+	encodingsMu sync.Mutex
+)
+
+// ForModel returns the encoding used by an OpenAI model name, cl100k_base for other models.
+func ForModel(modelName string) string {
+	name := strings.ToLower(modelName[strings.LastIndex(modelName, "/")+1:])
+
+	for _, prefix := range []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4", "chatgpt-4o"} {
+		if strings.HasPrefix(name, prefix) {
+			return O200K
+		}
+	}
+
+	return CL100K
+}
+
+// Count returns the number of tokens of text in the named encoding, or the
+// estimate when the encoding is not available.
+func Count(encodingName, text string) int {
+	if text == "" {
+		return 0
+	}
+
+	if encodingName == Estimate {
+		return EstimateCount(text)
+	}
+
+	encoding, err := Get(encodingName)
+	if err != nil {
+		return EstimateCount(text)
+	}
+
+	return encoding.Count(text)
+}
+
+// Get loads the encoding once. A missing encoding is remembered and logged only the first time.
+func Get(name string) (*Encoding, error) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+
+	encoding, ok := encodings[name]
+	if ok {
+		if encoding == nil {
+			return nil, fmt.Errorf("encoding %s is not available", name)
+		}
+
+		return encoding, nil
+	}
+
+	encoding, err := load(name)
+	if err != nil {
+		log.Printf("Tokenizer %s is not available, token counts are estimated: %v", name, err)
+	}
+
+	encodings[name] = encoding
+
+	return encoding, err
+}
+
+func load(name string) (*Encoding, error) {
+	var pattern *splitter
+
+	switch name {
+	case CL100K:
+		pattern = cl100kSplitter
+	case O200K:
+		pattern = o200kSplitter
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", name)
+	}
+
+	data, err := fs.ReadFile(bundled, "bpe/"+name+".tiktoken")
+	if err != nil && Dir != "" {
+		data, err = os.ReadFile(filepath.Join(Dir, name+".tiktoken"))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != checksums[name] {
+		return nil, fmt.Errorf("%s.tiktoken has checksum %x, expected %s", name, sum, checksums[name])
+	}
+
+	ranks, err := parseRanks(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parse %s: %w", name, err)
+	}
+
+	return &Encoding{name: name, ranks: ranks, pattern: pattern}, nil
+}
+
+// parseRanks reads the tiktoken format: a base64 token and its rank per line.
+func parseRanks(data []byte) (map[string]int, error) {
+	ranks := make(map[string]int)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for scanner.Scan() {
+		token, rank, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, err
+		}
+
+		ranks[string(decoded)] = n
+	}
+
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("no tokens")
+	}
+
+	return ranks, scanner.Err()
+}
+
+// Count returns the number of tokens of text.
+func (e *Encoding) Count(text string) int {
+	var count int
+
+	for _, piece := range e.pattern.split(text) {
+		count += e.countPiece(piece)
+	}
+
+	return count
+}
+
+// EstimateCount approximates the token count: about 4 ASCII characters, 2 characters
+// of other alphabets like Cyrillic or 1 CJK character per token.
+func EstimateCount(text string) int {
+	var ascii, other, tokens int
+
+	for _, r := range text {
+		switch {
+		case r < unicode.MaxASCII:
+			ascii++
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			tokens++
+		default:
+			other++
+		}
+	}
+
+	return tokens + (ascii+3)/4 + (other+1)/2
+}
+
+// Known reports whether name is a supported encoding or the estimate.
+func Known(name string) bool {
+	return name == CL100K || name == O200K || name == Estimate
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"cmp"
+
+	"ai-proxy/internal/schema"
+	"ai-proxy/internal/tokenizer"
+
+	"github.com/tidwall/gjson"
+)
+
+// Tokens added by the chat format, as counted by OpenAI.
+const (
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+	charsPerToken    = 4 // for models limited by max_request_length
+)
+
+// requestSize measures a chat request against the model limits, counting the
+// prompt tokens once per encoding.
+type requestSize struct {
+	body      []byte
+	length    int
+	maxTokens int
+	reserve   int // tokens kept free for a message added later
+	tokens    map[string]int
+}
+
+func newRequestSize(reqBodyBytes []byte) *requestSize {
+	return &requestSize{
+		body:   reqBodyBytes,
+		length: getRequestLength(reqBodyBytes),
+		maxTokens: int(cmp.Or(gjson.GetBytes(reqBodyBytes, "max_completion_tokens").Int(),
+			gjson.GetBytes(reqBodyBytes, "max_tokens").Int())),
+		tokens: make(map[string]int),
+	}
+}
+
+// fits reports whether the prompt plus max_tokens fit the context window of the
+// model, or the request fits max_request_length when no window is configured.
+func (r *requestSize) fits(model Model) bool {
+	if model.ContextWindow == 0 {
+		return fitsRequestLength(model, r.length+r.reserve*charsPerToken)
+	}
+
+	encoding := modelTokenizer(model)
+
+	tokens, ok := r.tokens[encoding]
+	if !ok {
+		tokens = promptTokens(r.body, encoding)
+		r.tokens[encoding] = tokens
+	}
+
+	return tokens+r.maxTokens+r.reserve <= model.ContextWindow
+}
+
+// fitsAny reports whether a model accepted by match has quota left and fits the request.
+func (r *requestSize) fitsAny(match func(Model) bool) bool {
+	return selectModel(func(model Model) bool {
+		return match(model) && r.fits(model)
+	}) != ""
+}
+
+func modelTokenizer(model Model) string {
+	return cmp.Or(model.Tokenizer, tokenizer.ForModel(model.Name))
+}
+
+// promptTokens counts the tokens of the messages and tools of a chat request.
+func promptTokens(reqBodyBytes []byte, encoding string) int {
+	tokens := tokensPerReply
+
+	for _, message := range gjson.GetBytes(reqBodyBytes, "messages").Array() {
+		tokens += tokensPerMessage + tokenizer.Count(encoding, message.Get("role").String())
+
+		content := message.Get("content")
+		tokens += tokenizer.Count(encoding, messageText(content))
+
+		if content.IsArray() {
+			for _, part := range content.Array() {
+				if part.Get("type").String() != "text" {
+					tokens += schema.AttachmentLength
+				}
+			}
+		}
+
+		if toolCalls := message.Get("tool_calls"); toolCalls.Exists() {
+			tokens += tokenizer.Count(encoding, toolCalls.Raw)
+		}
+	}
+
+	if tools := gjson.GetBytes(reqBodyBytes, "tools"); tools.Exists() {
+		tokens += tokenizer.Count(encoding, tools.Raw)
+	}
+
+	return tokens
+}
@@ -1,28 +1,24 @@
 package main
 
 import (
+	"cmp"
 	_ "embed"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 
 	"ai-proxy/internal"
-	"ai-proxy/internal/gigachat"
-
-	"gopkg.in/yaml.v3"
+	"ai-proxy/internal/limiter"
+	"ai-proxy/internal/storage"
+	"ai-proxy/internal/tokenizer"
 )
 
 //go:embed config.yaml
 var configBytes []byte
 
-// var config internal.Config
-
-type Config struct {
-	Models []internal.Model `yaml:"models"`
-}
-
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		if req.Header.Get("Authorization") != "Bearer QVBJIFRPS0VOIEZPUiBBSS1QUk9YWQ==" {
@@ -62,7 +58,7 @@ func listModels(w http.ResponseWriter, req *http.Request) {
 
 	models.Object = "list"
 
-	for _, v := range internal.Models {
+	for _, v := range internal.ModelList() {
 		models.Data = append(models.Data, Data{ID: v.Name})
 	}
 
@@ -78,24 +74,67 @@ func main() {
 	port := flag.Int("port", 8080, "Port to listen on")
 	flag.Parse()
 
-	var config Config
+	if flag.Arg(0) == "check-config" {
+		checkConfig(flag.Args()[1:])
 
-	err := yaml.Unmarshal(configBytes, &config)
+		return
+	}
+
+	config, err := loadConfig(configBytes)
 	if err != nil {
-		log.Fatalf("Error Unmarshal config: %v", err)
+		log.Fatalf("Invalid config:\n%v", err)
 	}
 
-	internal.RateLimits = make(map[string]*internal.RateLimit)
+	internal.RateLimits = make(map[string][]*internal.RateLimit)
+	internal.StructuredOutput = config.StructuredOutput
+	tokenizer.Dir = config.Tokenizer.Dir
+	internal.Pools = config.Pools
+	internal.CircuitBreaker = config.CircuitBreaker
+	internal.ProviderLimits = make(map[string]limiter.Config)
+	internal.Priority = config.Priority
+	internal.Providers = config.Providers
+
+	maps.Copy(internal.ProviderLimits, config.ProviderLimits)
+
+	for name, provider := range config.Providers {
+		if provider.Config != (limiter.Config{}) {
+			internal.ProviderLimits[name] = provider.Config
+		}
+	}
 
 	for _, v := range config.Models {
-		internal.Models = append(internal.Models, v)
-		internal.RateLimits[v.Name] = &internal.RateLimit{}
+		// load the vocabulary now instead of on the first request
+		if v.ContextWindow > 0 && v.Tokenizer != tokenizer.Estimate {
+			encoding := cmp.Or(v.Tokenizer, tokenizer.ForModel(v.Name))
+
+			if _, err := tokenizer.Get(encoding); err != nil {
+				log.Printf("WARNING: model %s counts its context_window with an estimate, as %s is not available; "+
+					"put %s.tiktoken into tokenizer.dir for exact counts", v.Name, encoding, encoding)
+			}
+		}
 
-		if v.Provider == "gigachat" {
-			gigachat.InitClient(v.Token)
+		internal.AddModel(v)
+
+		log.Printf("Load %s model %s", v.Type, v.Name)
+	}
+
+	internal.DiscoverModels(config.Providers)
+
+	if config.ImageStorage.Type != "" {
+		internal.Files, err = storage.New(config.ImageStorage)
+		if err != nil {
+			log.Fatalf("Error init image storage: %v", err)
 		}
 
-		log.Println("Load model ", v.Name)
+		internal.FilesConfig = config.ImageStorage
+
+		if config.ImageStorage.Retention > 0 {
+			go internal.CleanupFiles(config.ImageStorage.Retention)
+		}
+	}
+
+	if config.HealthCheck.Interval > 0 {
+		go internal.CheckHealth(config.HealthCheck)
 	}
 
 	log.Printf("Listening on port %d", *port)
@@ -103,10 +142,32 @@ func main() {
 	mux := http.NewServeMux()
 	// Register the middleware
 	// mux.HandleFunc("/", authMiddleware(handleHTTP))
-	mux.HandleFunc("/chat/completions", internal.HandlerTxt)
-	mux.HandleFunc("/image", internal.HandlerImage)
+
+	// OpenAI clients put /v1 into the base URL, so every route is served with and without it
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, handler)
+		mux.HandleFunc("/v1"+pattern, handler)
+	}
+
+	handle("/chat/completions", internal.HandlerTxt)
+	handle("/completions", internal.HandlerCompletions)
+	handle("/responses", internal.HandlerResponses)
+	handle("/responses/{id}", internal.HandlerGetResponse)
+	handle("/image", internal.HandlerImage)
+	handle("/images/edits", internal.HandlerImageEdit)
+	handle("/images/variations", internal.HandlerImageVariation)
+	handle("/audio/transcriptions", internal.HandlerTranscription)
+	handle("/audio/translations", internal.HandlerTranslation)
+	handle("/audio/speech", internal.HandlerSpeech)
+	handle("/files/{id}", internal.HandlerFile)
+	handle("/models", listModels)
 	mux.HandleFunc("/ping", ping)
-	mux.HandleFunc("/models", listModels)
+	mux.HandleFunc("/health", internal.HandlerHealth)
+	mux.HandleFunc("/metrics", internal.HandlerMetrics)
+
+	if config.Admin.Token != "" {
+		mux.Handle("/admin/", internal.AdminHandler(config.Admin))
+	}
 
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), mux))
 }